@@ -2,27 +2,31 @@ package client
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
-	"net/rpc"
 	"os"
-	"os/exec"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/coordinator"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/storage"
 )
 
 const (
-	ServerPath = "/home/akroy2/files/"
-	CoordinatorAddress = "fa22-cs425-3301.cs.illinois.edu"
-	BufferSize = 100000000
+	// chunks a client sends or fetches at once unless ParallelTransfers says otherwise
+	DefaultParallelTransfers = 8
 )
 
 type Client struct {
 	Self common.Node
+	Coordinators *common.Coordinators
+	ParallelTransfers int
 }
 
 /*func fillString(retunString string, toLength int) string {
@@ -37,241 +41,709 @@ type Client struct {
 	return retunString
 }*/
 
-func (c *Client) Put(local string, target string, version int) error {
+// keeps the reservation of a put alive while its blocks make progress
+type lease struct {
+	c *Client
+	name string
+	upload string
+	renewed time.Time
+	mu sync.Mutex
+}
+
+// renews the reservation unless that was done less than a third of the lease ago
+func (l *lease) renew() {
+	l.mu.Lock()
+	if time.Since(l.renewed) < coordinator.UploadLease / 3 {
+		l.mu.Unlock()
+		return
+	}
+	l.renewed = time.Now()
+	l.mu.Unlock()
+	req := common.RenewPutRequest{
+		Name: l.name,
+		UploadID: l.upload,
+	}
+	if err := l.c.call("Coordinator.RenewPut", &req, new(common.RenewPutAck), coordinator.RequestTimeout); err != nil {
+		log.Printf("renewing the put of [%s]: %v", l.name, err)
+	}
+}
+
+// gives the reservation of a failed put up, a coordinator that is not reached lets its lease run out
+func (l *lease) abort() {
+	req := common.AbortPutRequest{
+		Name: l.name,
+		UploadID: l.upload,
+	}
+	if err := l.c.call("Coordinator.AbortPut", &req, new(common.AbortPutAck), coordinator.RequestTimeout); err != nil {
+		log.Printf("aborting the put of [%s]: %v", l.name, err)
+	}
+}
+
+// streams length bytes of the local file starting at offset to one replica block by block,
+// returns the number of bytes staged there
+func (c *Client) sendChunk(local string, offset int64, length int64, replica string, name string, version int, l *lease) (int64, error) {
+	f, err := os.Open(local)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	r := io.NewSectionReader(f, offset, length)
+	addr := replica
+	buf := make([]byte, common.BlockSize)
+	var sent int64
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		// always send at least one block so empty chunks are staged too
+		if n > 0 || sent == 0 {
+			block := common.WriteBlockRequest{
+				Name: name,
+				Version: version,
+				UploadID: l.upload,
+				Offset: sent,
+				Data: buf[:n],
+			}
+			if err := c.Coordinators.Transport.Call(addr, "Replica.WriteBlock", &block, new(common.WriteBlockAck), coordinator.RequestTimeout); err != nil {
+				return 0, err
+			}
+			sent += int64(n)
+			l.renew()
+		}
+		if n < len(buf) {
+			break
+		}
+	}
+	return sent, nil
+}
+
+// calls the leader and decodes the error it answers with, so callers can tell what went wrong by its code
+func (c *Client) call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	return common.Decode(c.Coordinators.Call(method, args, reply, timeout))
+}
+
+// number of chunk transfers a client runs at once
+func (c *Client) parallelTransfers() int {
+	if c.ParallelTransfers > 0 {
+		return c.ParallelTransfers
+	}
+	return DefaultParallelTransfers
+}
+
+func (c *Client) Put(local string, target string, version int) (err error) {
 	log.Printf("putting local file [%s] on SDFS as [%s]", local, target)
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
+	info, err := os.Stat(local)
+	if errors.Is(err, os.ErrNotExist) {
+		return common.Errorf(common.NotFound, "local file [%s] does not exist", local)
+	}
 	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		ack := new(common.PutAck)
-		pr := common.PutRequest{
-			Name: target,
-			Source: c.Self.Address,
+		return err
+	}
+	pr := common.PutRequest{
+		Name: target,
+		Source: c.Self.Addr(),
+		Size: info.Size(),
+	}
+	resp := new(common.PutResponse)
+	err = c.call("Coordinator.Put", &pr, resp, coordinator.RequestTimeout)
+	if err != nil {
+		return err
+	}
+	l := &lease{
+		c: c,
+		name: target,
+		upload: resp.UploadID,
+		renewed: time.Now(),
+	}
+	defer func() {
+		if err != nil {
+			l.abort()
+		}
+	}()
+
+	f, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// stream every chunk to each of its replicas, the replicas that got all of a chunk take part in its commit
+	type staged struct {
+		chunk int
+		replica string
+		size int64
+	}
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, c.parallelTransfers())
+	transfers := 0
+	for _, replicas := range resp.Chunks {
+		transfers += len(replicas)
+	}
+	results := make(chan staged, transfers)
+	// every replica checks its copy of a chunk against the checksum before preparing it
+	checksums := make([]string, len(resp.Chunks))
+	for i, replicas := range resp.Chunks {
+		offset := int64(i) * resp.ChunkSize
+		length := resp.ChunkSize
+		if offset + length > pr.Size {
+			length = pr.Size - offset
 		}
-		call := client.Go("Coordinator.Put", &pr, &ack, nil)
-		select {
-		case <- call.Done:
-			// send file to client
-		case <- time.After(coordinator.RequestTimeout):
+		name := common.ChunkName(target, i)
+		checksums[i], err = storage.Checksum(io.NewSectionReader(f, offset, length))
+		if err != nil {
+			wg.Wait()
 			return err
 		}
+		for _, replica := range replicas {
+			wg.Add(1)
+			sem <- struct{}{}
+			go func(i int, replica string) {
+				defer wg.Done()
+				defer func() { <- sem }()
+				size, err := c.sendChunk(local, offset, length, replica, name, resp.Version, l)
+				if err != nil {
+					log.Printf("sending [%s] to [%s]: %v", name, replica, err)
+					return
+				}
+				results <- staged{i, replica, size}
+			}(i, replica)
+		}
 	}
+	wg.Wait()
+	close(results)
+	commit := common.CommitPutRequest{
+		Name: target,
+		Version: resp.Version,
+		UploadID: resp.UploadID,
+		Size: pr.Size,
+		Chunks: make([]common.ChunkCommit, len(resp.Chunks)),
+	}
+	for i := range commit.Chunks {
+		commit.Chunks[i].Participants = []string{}
+		commit.Chunks[i].Checksum = checksums[i]
+	}
+	for r := range results {
+		commit.Chunks[r.chunk].Participants = append(commit.Chunks[r.chunk].Participants, r.replica)
+		commit.Chunks[r.chunk].Size = r.size
+	}
+
+	// the coordinator rolls the staged copies back if a chunk missed the write quorum
+	err = c.call("Coordinator.CommitPut", &commit, new(common.PutAck), coordinator.PutCommitTimeout(resp.ChunkSize))
+	if err != nil {
+		return err
+	}
+	log.Printf("stored [%s] version [%d] in [%d] chunks", target, resp.Version, len(commit.Chunks))
 	return nil
 }
 
-func (c *Client) Get(target string, local string, version int) error {
-	log.Printf("downloading sdfs file [%s] to local file [%s]", target, local)
-	cmd := exec.Command("/usr/bin/cp", ServerPath + target, local)
-	err := cmd.Run()
+// downloads one version of an sdfs file from a single replica into w
+func (c *Client) receiveFile(replica string, name string, version int, w io.Writer) error {
+	addr := replica
+	var offset int64
+	for {
+		req := common.ReadBlockRequest{
+			Name: name,
+			Version: version,
+			Offset: offset,
+			Length: common.BlockSize,
+		}
+		resp := new(common.ReadBlockResponse)
+		if err := c.Coordinators.Transport.Call(addr, "Replica.ReadBlock", &req, resp, coordinator.RequestTimeout); err != nil {
+			return err
+		}
+		// pin the version the replica picked so later blocks come from the same one
+		version = resp.Version
+		if _, err := w.Write(resp.Data); err != nil {
+			return err
+		}
+		offset += int64(len(resp.Data))
+		if resp.EOF || len(resp.Data) == 0 {
+			return nil
+		}
+	}
+}
+
+// writes a local file through a temporary file in the same directory so readers never see a partial file
+func writeAtomically(local string, write func(f *os.File) error) error {
+	tmp, err := os.CreateTemp(filepath.Dir(local), "."+filepath.Base(local)+".sdfs-*")
 	if err != nil {
-		log.Println("copy error", err)
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := write(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), local)
+}
+
+// writes to a file at a position of its own, so several chunks can be written at once
+type offsetWriter struct {
+	f *os.File
+	offset int64
+	written int64
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.offset + w.written)
+	w.written += int64(n)
+	return n, err
+}
+
+// tells the coordinator a replica served a corrupt copy so it gets replaced
+func (c *Client) reportCorruption(replica string, name string, version int) {
+	report := common.CorruptionReport{
+		Name: name,
+		Version: version,
+		Replica: replica,
+	}
+	if err := c.call("Coordinator.ReportCorruption", &report, new(common.CorruptionAck), coordinator.RequestTimeout); err != nil {
+		log.Printf("could not report corrupt [%s] version [%d] on [%s]: %v", name, version, replica, err)
+	}
+}
+
+// writes one chunk of a version into f at offset, trying the replicas one after another until
+// one of them serves the whole chunk. A copy that fails the checksum is reported and the next replica is tried.
+// Returns the replica that served it.
+func (c *Client) fetchChunk(f *os.File, offset int64, chunk common.ChunkInfo, replicas []string, name string, version int) (string, error) {
+	var err error
+	for _, replica := range replicas {
+		w := &offsetWriter{
+			f: f,
+			offset: offset,
+		}
+		err = c.receiveFile(replica, name, version, w)
+		if err == nil && w.written != chunk.Size {
+			err = fmt.Errorf("got [%d] of [%d] bytes", w.written, chunk.Size)
+		}
+		if err == nil && chunk.Checksum != "" {
+			// hash what landed in the file, so a bad write is caught as well
+			var checksum string
+			checksum, err = storage.Checksum(io.NewSectionReader(f, offset, chunk.Size))
+			if err == nil && checksum != chunk.Checksum {
+				err = fmt.Errorf("checksum [%s] does not match [%s]", checksum, chunk.Checksum)
+				c.reportCorruption(replica, name, version)
+			}
+		}
+		if err == nil {
+			log.Printf("downloaded [%s] version [%d] from [%s]", name, version, replica)
+			return replica, nil
+		}
+		log.Printf("could not download [%s] version [%d] from [%s]: %v", name, version, replica, err)
+	}
+	if err == nil {
+		err = fmt.Errorf("no replicas")
+	}
+	return "", common.Errorf(common.Unavailable, "no replica could serve [%s] version [%d]: %w", name, version, err)
+}
+
+// asks the replica that served a chunk to push it to the replicas found behind. The requests are
+// sent before the get returns, so a one-shot command exiting right after does not lose them,
+// the pushes themselves run on the replica without the get waiting for them.
+func (c *Client) readRepair(source string, behind []string, name string, version int, checksum string) {
+	for _, replica := range behind {
+		req := common.ReadRepairRequest{
+			Name: name,
+			Version: version,
+			Destination: replica,
+			Checksum: checksum,
+		}
+		if err := c.Coordinators.Transport.Call(source, "Replica.ReadRepair", &req, new(common.ReadRepairAck), coordinator.RequestTimeout); err != nil {
+			log.Printf("could not repair [%s] version [%d] on [%s]: %v", name, version, replica, err)
+			continue
+		}
+		log.Printf("[%s] is behind on [%s] version [%d], [%s] pushes it", replica, name, version, source)
+	}
+}
+
+// writes every chunk of one version of an sdfs file into f starting at offset, up to
+// ParallelTransfers chunks at once. holders returns the replicas to try for a chunk and
+// the replicas found behind, which get repaired once the chunk is read.
+func (c *Client) fetchVersion(f *os.File, offset int64, name string, version int, manifest common.Manifest, holders func(i int) ([]string, []string, error)) error {
+	wg := sync.WaitGroup{}
+	sem := make(chan struct{}, c.parallelTransfers())
+	errs := make(chan error, len(manifest.Chunks))
+	for i, chunk := range manifest.Chunks {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, chunkOffset int64, chunk common.ChunkInfo) {
+			defer wg.Done()
+			defer func() { <- sem }()
+			replicas, behind, err := holders(i)
+			if err != nil {
+				errs <- err
+				return
+			}
+			source, err := c.fetchChunk(f, chunkOffset, chunk, replicas, common.ChunkName(name, i), version)
+			if err != nil {
+				errs <- err
+				return
+			}
+			if len(behind) > 0 {
+				c.readRepair(source, behind, common.ChunkName(name, i), version, chunk.Checksum)
+			}
+		}(i, offset, chunk)
+		offset += chunk.Size
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		return err
 	}
 	return nil
 }
 
-func (c *Client) Join() error {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
+// asks every replica of a chunk which versions it stores and returns the replicas holding the
+// version and the ones whose latest version is older, failing unless at least quorum replicas answered
+func (c *Client) readQuorum(replicas []string, name string, version int, quorum int) ([]string, []string, error) {
+	type answer struct {
+		replica string
+		has bool
+		behind bool
+	}
+	wg := sync.WaitGroup{}
+	answers := make(chan answer, len(replicas))
+	for _, replica := range replicas {
+		wg.Add(1)
+		go func(replica string) {
+			defer wg.Done()
+			req := common.StoredVersionsRequest{
+				Name: name,
+			}
+			resp := new(common.StoredVersionsResponse)
+			err := c.Coordinators.Transport.Call(replica, "Replica.StoredVersions", &req, resp, coordinator.RequestTimeout)
+			if err != nil {
+				log.Printf("could not query [%s] on [%s]: %v", name, replica, err)
+				return
+			}
+			has := false
+			latest := 0
+			for _, v := range resp.Versions {
+				if v == version {
+					has = true
+				}
+				if v > latest {
+					latest = v
+				}
+			}
+			answers <- answer{replica, has, latest < version}
+		}(replica)
+	}
+	wg.Wait()
+	close(answers)
+
+	responded := 0
+	holders := []string{}
+	behind := []string{}
+	for a := range answers {
+		responded += 1
+		if a.has {
+			holders = append(holders, a.replica)
+		} else if a.behind {
+			behind = append(behind, a.replica)
+		}
+	}
+	if responded < quorum {
+		return nil, nil, common.Errorf(common.QuorumNotMet, "[%d] replicas of [%s] answered, read quorum is [%d]", responded, name, quorum)
+	}
+	if len(holders) == 0 {
+		return nil, nil, common.Errorf(common.Unavailable, "no replica stores [%s] version [%d]", name, version)
+	}
+	return holders, behind, nil
+}
+
+// looks up the manifest of one version of a file
+func (c *Client) manifest(target string, version int, latest int) (common.Manifest, error) {
+	req := common.GetVersionsRequest{
+		NumVersions: latest - version + 1,
+		Filename: target,
+	}
+	resp := new(common.GetVersionsResponse)
+	if err := c.call("Coordinator.GetVersions", &req, resp, coordinator.RequestTimeout); err != nil {
+		return common.Manifest{}, err
+	}
+	for i, v := range resp.Versions {
+		if v == version {
+			return resp.Manifests[i], nil
+		}
+	}
+	return common.Manifest{}, common.Errorf(common.NotFound, "[%s] has no version [%d]", target, version)
+}
+
+// Get downloads one version of an sdfs file, the latest one if version is not positive.
+// Every chunk is read from the replicas a read quorum of its replica set confirms hold it.
+func (c *Client) Get(target string, local string, version int) error {
+	log.Printf("downloading sdfs file [%s] to local file [%s]", target, local)
+	req := common.LsRequest{
+		Filename: target,
+	}
+	resp := new(common.LsResponse)
+	err := c.call("Coordinator.Ls", &req, resp, coordinator.RequestTimeout)
 	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		ack := new(common.JoinAck)
-		call := client.Go("Coordinator.Join", &c.Self, &ack, nil)
-		select {
-		case <- call.Done:
-			log.Printf("successfully joined client to sdfs")
-		case <- time.After(coordinator.RequestTimeout):
-			log.Printf("unable to join client to sdfs")
+		return err
+	}
+	if len(resp.Addresses) == 0 || len(resp.Manifest.Chunks) == 0 {
+		return common.Errorf(common.NotFound, "file [%s] does not exist in SDFS", target)
+	}
+	manifest := resp.Manifest
+	if version <= 0 {
+		version = resp.Version
+	} else if version != resp.Version {
+		manifest, err = c.manifest(target, version, resp.Version)
+		if err != nil {
 			return err
 		}
 	}
+	if len(manifest.Chunks) > len(resp.Chunks) {
+		return common.Errorf(common.Unavailable, "[%s] version [%d] has [%d] chunks, only [%d] are placed", target, version, len(manifest.Chunks), len(resp.Chunks))
+	}
+	err = writeAtomically(local, func(f *os.File) error {
+		return c.fetchVersion(f, 0, target, version, manifest, func(i int) ([]string, []string, error) {
+			return c.readQuorum(resp.Chunks[i], common.ChunkName(target, i), version, resp.ReadQuorum)
+		})
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("downloaded [%s] version [%d] (%d bytes in %d chunks)", target, version, manifest.Size, len(manifest.Chunks))
+	return nil
+}
+
+func (c *Client) Join() error {
+	ack := new(common.JoinAck)
+	if err := c.call("Coordinator.Join", &c.Self, ack, coordinator.ReplicationTimeout); err != nil {
+		return err
+	}
+	log.Printf("successfully joined client to sdfs")
 	return nil
 }
 
 func (c *Client) Leave() error {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
-	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		ack := new(common.JoinAck)
-		call := client.Go("Coordinator.Leave", &c.Self, &ack, nil)
-		select {
-		case <- call.Done:
-			log.Printf("successfully exited client to sdfs")
-		case <- time.After(coordinator.RequestTimeout):
-			log.Printf("unable to exit client tfromo sdfs")
-			return err
-		}
+	ack := new(common.LeaveAck)
+	if err := c.call("Coordinator.Leave", &c.Self, ack, coordinator.ReplicationTimeout); err != nil {
+		return err
 	}
+	log.Printf("successfully removed client from sdfs")
 	return nil
 }
 
 func (c *Client) ListSelf() error {
-	log.Printf("Self: %s", c.Self.Address)
+	log.Printf("Self: %s", c.Self.Addr())
 	return nil
 }
 
 func (c *Client) ListMem() error {
 	output := "Membership List:\n---------------\n"
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
 	req := new(common.MemListRequest)
 	resp := new(common.MemListResponse)
-	call := client.Go("Coordinator.MemList", req, resp, nil)
-	select {
-	case <- call.Done:
-		for address := range *resp {
-			output += address + "\n"
-		}
-	case <- time.After(coordinator.RequestTimeout):
-		log.Printf("unable to exit client tfromo sdfs")
+	if err := c.call("Coordinator.MemList", req, resp, coordinator.RequestTimeout); err != nil {
 		return err
 	}
+	for address := range *resp {
+		output += address + "\n"
+	}
 	log.Println(output)
 	return nil
 }
 
 func (c *Client) Delete(target string) error {
 	log.Printf("deleting [%s]", target)
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
-	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		req := common.DeleteRequest{
-			Filename: target,
-		}
-		resp := new(common.DeleteResponse)
-		call := client.Go("Coordinator.Delete", &req, &resp, nil)
-		select {
-		case <- call.Done:
-			if *resp {
-				log.Printf("successfully deleted file [%s] from SDFS", target)
-			} else {
-				log.Printf("file [%s] does not exist in SDFS", target)
-			}
-		case <- time.After(coordinator.RequestTimeout):
-			return err
-		}
+	req := common.DeleteRequest{
+		Filename: target,
+	}
+	resp := new(common.DeleteResponse)
+	if err := c.call("Coordinator.Delete", &req, resp, coordinator.CommitTimeout); err != nil {
+		return err
+	}
+	if !*resp {
+		return common.Errorf(common.NotFound, "file [%s] does not exist in SDFS", target)
 	}
+	log.Printf("successfully deleted file [%s] from SDFS", target)
 	return nil
 }
 
 func (c *Client) ListReplicas(target string) error {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
 	req := new(common.LsRequest)
 	req.Filename = target
 	resp := new(common.LsResponse)
-	call := client.Go("Coordinator.Ls", req, resp, nil)
 	output := "Replicas for " + target + ":\n-----------------------\n"
-	select {
-	case <- call.Done:
-		for _, address := range resp.Addresses {
-			output += address + "\n"
-		}
-	case <- time.After(coordinator.RequestTimeout):
-		log.Printf("unable to exit client tfromo sdfs")
+	if err := c.call("Coordinator.Ls", req, resp, coordinator.RequestTimeout); err != nil {
 		return err
 	}
+	if len(resp.Addresses) == 0 {
+		return common.Errorf(common.NotFound, "file [%s] does not exist in SDFS", target)
+	}
+	for _, address := range resp.Addresses {
+		output += address + "\n"
+	}
 	log.Println(output)
 	return nil
 }
 
 func (c *Client) ListFiles(address string) error {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
 	req := new(common.StoreRequest)
-	req.Address = c.Self.Address
+	req.Address = address
 	resp := new(common.StoreResponse)
-	call := client.Go("Coordinator.Store", req, resp, nil)
-	output := "Files on local server " + c.Self.Address + ":\n-----------------------\n"
-	select {
-	case <- call.Done:
-		for _, file := range resp.Files {
-			output += file + "\n"
-		}
-	case <- time.After(coordinator.RequestTimeout):
-		log.Printf("unable to exit client tfromo sdfs")
+	output := "Files on local server " + address + ":\n-----------------------\n"
+	if err := c.call("Coordinator.Store", req, resp, coordinator.RequestTimeout); err != nil {
 		return err
 	}
+	for _, file := range resp.Files {
+		output += file + "\n"
+	}
 	log.Println(output)
 	return nil
 }
 
+// versionHeader separates the versions written by get-versions
+func versionHeader(name string, version int) string {
+	return fmt.Sprintf("==================== [%s] version [%d] ====================\n", name, version)
+}
+
 func (c *Client) GetVersions(target string, numVersions int, local string) error {
-	fmt.Printf("querying last [%d] versions of [%s] to [%s]", numVersions, target, local)
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", CoordinatorAddress, coordinator.DefaultPort))
-	req := new(common.GetVersionsRequest)
-	req.NumVersions = numVersions
-	req.Filename = target
+	log.Printf("querying last [%d] versions of [%s] to [%s]", numVersions, target, local)
+	if numVersions < 1 {
+		return common.Errorf(common.Invalid, "number of versions must be positive, got [%d]", numVersions)
+	}
+	req := common.GetVersionsRequest{
+		NumVersions: numVersions,
+		Filename: target,
+	}
 	resp := new(common.GetVersionsResponse)
-	call := client.Go("Coordinator.GetVersions", req, resp, nil)
-	output := fmt.Sprintf("Aggregating versions for [%s] ", target) + c.Self.Address + ":\n-----------------------\n"
-	select {
-	case <- call.Done:
-		for _, version := range resp.Versions {
-			output += version + "\n"
+	err := c.call("Coordinator.GetVersions", &req, resp, coordinator.RequestTimeout)
+	if err != nil {
+		return err
+	}
+	if len(resp.Versions) == 0 || len(resp.Chunks) == 0 {
+		return common.Errorf(common.NotFound, "file [%s] does not exist in SDFS", target)
+	}
+	err = writeAtomically(local, func(f *os.File) error {
+		for i, version := range resp.Versions {
+			if i > 0 {
+				if _, err := f.WriteString("\n"); err != nil {
+					return err
+				}
+			}
+			if _, err := f.WriteString(versionHeader(target, version)); err != nil {
+				return err
+			}
+			offset, err := f.Seek(0, io.SeekCurrent)
+			if err != nil {
+				return err
+			}
+			manifest := resp.Manifests[i]
+			err = c.fetchVersion(f, offset, target, version, manifest, func(chunk int) ([]string, []string, error) {
+				if chunk >= len(resp.Chunks) {
+					return nil, nil, common.Errorf(common.Unavailable, "chunk [%d] of [%s] is not placed", chunk, target)
+				}
+				return resp.Chunks[chunk], nil, nil
+			})
+			if err != nil {
+				return err
+			}
+			if _, err := f.Seek(offset + manifest.Size, io.SeekStart); err != nil {
+				return err
+			}
 		}
-	case <- time.After(coordinator.RequestTimeout):
-		log.Printf("unable to exit client tfromo sdfs")
+		return nil
+	})
+	if err != nil {
 		return err
 	}
-	log.Println(output)
+	log.Printf("wrote [%d] versions of [%s] to [%s]", len(resp.Versions), target, local)
 	return nil
 }
 
+// exit status of the command line for each error code, any other error exits with 1
+var exitCodes = map[string]int{
+	common.Invalid: 2,
+	common.NotFound: 3,
+	common.Timeout: 4,
+	common.QuorumNotMet: 5,
+	common.Conflict: 6,
+	common.Unavailable: 7,
+}
+
+// ExitCode is the status the command line exits with after a command failed with err
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if code, ok := exitCodes[common.CodeOf(err)]; ok {
+		return code
+	}
+	return 1
+}
+
+// Exec runs one command given as its tokens, e.g. put <local> <sdfs name>
+func (c *Client) Exec(tokens []string) error {
+	invalid := common.Errorf(common.Invalid, "invalid command: %s", strings.Join(tokens, " "))
+	if len(tokens) < 1 {
+		return invalid
+	}
+	if len(tokens) == 1 {
+		switch tokens[0] {
+		case "store":
+			return c.ListFiles(c.Self.Addr())
+		case "join":
+			return c.Join()
+		case "leave":
+			return c.Leave()
+		case "list_mem":
+			return c.ListMem()
+		case "list_self":
+			return c.ListSelf()
+		}
+	} else if len(tokens) == 2 {
+		switch (tokens[0]) {
+		case "delete":
+			return c.Delete(tokens[1])
+		case "ls":
+			return c.ListReplicas(tokens[1])
+		}
+	} else if len(tokens) == 3 {
+		switch (tokens[0]) {
+		case "get":
+			return c.Get(tokens[1], tokens[2], -1)
+		case "put":
+			return c.Put(tokens[1], tokens[2], -1)
+		}
+	} else if len(tokens) == 4 {
+		switch (tokens[0]) {
+		case "get-versions":
+			val, err := strconv.Atoi(tokens[2])
+			if err != nil {
+				return common.Errorf(common.Invalid, "number of versions must be a number, got [%s]", tokens[2])
+			}
+			return c.GetVersions(tokens[1], val, tokens[3])
+		}
+	}
+	return invalid
+}
+
+// Run executes the commands read from stdin one per line, a failed command is reported and the next one is read
 func (c *Client) Run() {
 	scanner := bufio.NewScanner(os.Stdin)
 	for scanner.Scan() {
 		cmd := scanner.Text()
-		tokens := strings.Split(cmd, " ")
-		if len(tokens) < 1 {
+		tokens := strings.Fields(cmd)
+		if len(tokens) == 0 {
 			continue
 		}
-		if len(tokens) == 1 {
-			switch tokens[0] {
-			case "store":
-				c.ListFiles(c.Self.Address)
-			case "join":
-				c.Join()
-			case "leave":
-				c.Leave()
-			case "list_mem":
-				c.ListMem()
-			case "list_self":
-				c.ListSelf()
-			default:
-				log.Printf("invalid command: %s", cmd)
-			}
-		} else if len(tokens) == 2 {
-			switch (tokens[0]) {
-			case "delete":
-				c.Delete(tokens[1])
-			case "ls":
-				c.ListReplicas(tokens[1])
-			default:
-				log.Printf("invalid command: %s", cmd)
-			}
-		} else if len(tokens) == 3 {
-			switch (tokens[0]) {
-			case "get":
-				c.Get(tokens[1], tokens[2], -1)
-			case "put":
-				err := c.Put(tokens[1], tokens[2], -1)
-				if err != nil {
-					log.Println(err.Error())
-				}
-			default:
-				log.Printf("invalid command: %s", cmd)
-			}
-		} else if len(tokens) == 4{
-			switch (tokens[0]) {
-			case "get-versions":
-				val, err := strconv.Atoi(tokens[2])
-				if err != nil {
-					log.Printf("invalid command: %s", cmd)
-					break
-				}
-				c.GetVersions(tokens[1], val, tokens[3])
-			}
-		} else {
-			log.Printf("invalid command: %s", cmd)
+		if err := c.Exec(tokens); err != nil {
+			log.Printf("%s failed: %v", tokens[0], err)
 		}
 	}
-}
\ No newline at end of file
+}
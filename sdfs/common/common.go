@@ -1,5 +1,14 @@
 package common
 
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
 const (
 	DeleteFileOp = 1
 	UpdateFileOp = 2
@@ -7,12 +16,34 @@ const (
 	ReadFileOp = 4
 )
 
+const (
+	// BlockSize is the largest payload carried by a single WriteBlock call
+	BlockSize = 1 << 20
+	// DefaultChunkSize is the size files are split at, every chunk is placed on the ring on its own
+	DefaultChunkSize = 64 << 20
+	// ChunkSeparator joins a file name and a chunk index, file names cannot contain it
+	ChunkSeparator = "#"
+	// FlushRate is the slowest rate in bytes per second a node is expected to flush staged data to disk at
+	FlushRate = 16 << 20
+)
+
+// FlushTimeout is timeout plus the time a call may take to flush size bytes to disk
+func FlushTimeout(timeout time.Duration, size int64) time.Duration {
+	return timeout + time.Duration(float64(size) / FlushRate * float64(time.Second))
+}
+
 type Node struct {
 	Address          string
 	Port             int
 	IterationNumber  int
 }
 
+// Addr is the host:port of the node's rpc server, it identifies the node on the ring
+// so several nodes can share a host
+func (n Node) Addr() string {
+	return fmt.Sprintf("%s:%d", n.Address, n.Port)
+}
+
 type Failure struct {
 	Address string
 }
@@ -21,25 +52,204 @@ type Replication struct {
 	Source string
 	Destination string
 	FileGroup
+	// checksum every version must have, the copy is refused otherwise
+	Checksums map[int]string
 }
 
 type AddressSet map[string]struct{}
 
+// NewUploadID returns a random id for one upload of a version, the replicas stage every upload on its own
+func NewUploadID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ChunkName is the name a chunk of a file is stored under on its replicas
+func ChunkName(name string, index int) string {
+	return fmt.Sprintf("%s%s%d", name, ChunkSeparator, index)
+}
+
+// ParseChunkName splits a chunk name into the file name and the chunk index
+func ParseChunkName(chunk string) (string, int, bool) {
+	i := strings.LastIndex(chunk, ChunkSeparator)
+	if i < 0 {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(chunk[i+len(ChunkSeparator):])
+	if err != nil || index < 0 {
+		return "", 0, false
+	}
+	return chunk[:i], index, true
+}
+
+// Chunk is where one chunk of a file lives, its replicas hold that chunk of every version
+type Chunk struct {
+	Replicas AddressSet
+}
+
+// ChunkInfo describes one chunk of one version of a file
+type ChunkInfo struct {
+	Size int64
+	// hex encoded SHA-256 of the chunk, computed by the client that put it
+	Checksum string
+}
+
+// Manifest lists the chunks one version of a file is made of, in order
+type Manifest struct {
+	Size int64
+	Chunks []ChunkInfo
+}
+
 type FileGroup struct {
 	Name string
 	Version int
+	// every replica holding a chunk of the file
 	Replicas AddressSet
+	// placement of every chunk index a stored version uses
+	Chunks []Chunk
+	// chunks of every committed version
+	Manifests map[int]Manifest
+}
+
+// Clone copies the file group so the copy can be changed without touching the original
+func (fg FileGroup) Clone() FileGroup {
+	clone := FileGroup{
+		Name: fg.Name,
+		Version: fg.Version,
+		Replicas: AddressSet{},
+		Chunks: []Chunk{},
+		Manifests: map[int]Manifest{},
+	}
+	for r := range fg.Replicas {
+		clone.Replicas[r] = struct{}{}
+	}
+	for _, chunk := range fg.Chunks {
+		replicas := AddressSet{}
+		for r := range chunk.Replicas {
+			replicas[r] = struct{}{}
+		}
+		clone.Chunks = append(clone.Chunks, Chunk{Replicas: replicas})
+	}
+	for version, manifest := range fg.Manifests {
+		clone.Manifests[version] = manifest
+	}
+	return clone
+}
+
+// ChunkVersion is the newest version that has the chunk at index, 0 if none has it
+func (fg FileGroup) ChunkVersion(index int) int {
+	latest := 0
+	for version, manifest := range fg.Manifests {
+		if index < len(manifest.Chunks) && version > latest {
+			latest = version
+		}
+	}
+	return latest
+}
+
+// ChunkReplicas lists the replicas of every chunk index
+func (fg FileGroup) ChunkReplicas() [][]string {
+	output := [][]string{}
+	for _, chunk := range fg.Chunks {
+		replicas := []string{}
+		for r := range chunk.Replicas {
+			replicas = append(replicas, r)
+		}
+		output = append(output, replicas)
+	}
+	return output
 }
 
 type PutRequest struct {
 	Source string
 	Name string
+	Size int64
+}
+
+type PutResponse struct {
+	Version int
+	// the upload the coordinator reserved the version for, the client tags every block and the commit with it
+	UploadID string
+	ChunkSize int64
+	// replicas of every chunk of the put
+	Chunks [][]string
+	WriteQuorum int
+}
+
+type WriteBlockRequest struct {
+	Name string
+	Version int
+	UploadID string
+	Offset int64
+	Data []byte
+}
+
+type CommitWriteRequest struct {
+	Name string
+	Version int
+	UploadID string
+	Size int64
+	// hex encoded SHA-256 of the data, not verified when empty
+	Checksum string
+}
+
+type ReadBlockRequest struct {
+	Name string
+	Version int
+	Offset int64
+	Length int
+}
+
+type ReadBlockResponse struct {
+	Version int
+	Data []byte
+	EOF bool
+}
+
+type StoredVersionsRequest struct {
+	Name string
+}
+
+type StoredVersionsResponse struct {
+	Versions []int
 }
 
 type FileUpdate struct {
 	Name string
 	Version int
+	// the upload that staged the version on the replica
+	UploadID string
 	OpType int
+	Size int64
+	Checksum string
+}
+
+type CommitPutRequest struct {
+	Name string
+	Version int
+	UploadID string
+	Size int64
+	Chunks []ChunkCommit
+}
+
+type RenewPutRequest struct {
+	Name string
+	UploadID string
+}
+
+type AbortPutRequest struct {
+	Name string
+	UploadID string
+}
+
+type ChunkCommit struct {
+	Size int64
+	Checksum string
+	// replicas that received every block of the chunk
+	Participants []string
 }
 
 type LsRequest struct {
@@ -48,6 +258,11 @@ type LsRequest struct {
 
 type LsResponse struct {
 	Addresses []string
+	Version int
+	ReadQuorum int
+	// replicas of every chunk and the chunks of Version
+	Chunks [][]string
+	Manifest Manifest
 }
 
 type StoreRequest struct {
@@ -64,7 +279,11 @@ type GetVersionsRequest struct {
 }
 
 type GetVersionsResponse struct {
-	Versions []string
+	// newest first, with the chunks of each version
+	Versions []int
+	Manifests []Manifest
+	// replicas of every chunk
+	Chunks [][]string
 }
 
 type DeleteRequest struct {
@@ -83,12 +302,23 @@ type P2Ack struct {}
 
 type RollbackAck struct{}
 
-type FDPing struct{}
+type FDPing struct {
+	// the coordinator that is pinging, so replicas learn who leads
+	Leader string
+}
 
 type FDAck struct{}
 
 type PutAck struct{}
 
+type RenewPutAck struct{}
+
+type AbortPutAck struct{}
+
+type WriteBlockAck struct{}
+
+type CommitWriteAck struct{}
+
 type JoinAck struct{}
 
 type LeaveAck struct{}
@@ -100,3 +330,82 @@ type FailureDetectedAck struct{}
 type ReplicationReceivedAck struct{}
 
 type ReplicationSentAck struct{}
+
+// CorruptionReport names a copy of a chunk version that does not match its checksum,
+// or that is missing from a replica that should hold it
+type CorruptionReport struct {
+	Name string
+	Version int
+	Replica string
+	Missing bool
+}
+
+type CorruptionAck struct{}
+
+type AssignedRequest struct {
+	Address string
+}
+
+// AssignedChunk is a chunk a replica should hold with the checksum of every version of it,
+// empty for versions put without one, and every replica of the chunk
+type AssignedChunk struct {
+	Name string
+	Checksums map[int]string
+	Replicas []string
+}
+
+type AssignedResponse struct {
+	Chunks []AssignedChunk
+}
+
+// ReadRepairRequest asks a replica holding a version to push it to a replica a get found behind
+type ReadRepairRequest struct {
+	Name string
+	Version int
+	Destination string
+	Checksum string
+}
+
+type ReadRepairAck struct{}
+
+// Hint is a version a replica missed, kept by a replica holding it until the target is back
+type Hint struct {
+	Target string
+	Name string
+	Version int
+	Checksum string
+}
+
+type HintAck struct{}
+
+type MetricsRequest struct{}
+
+// MetricsResponse holds the counters of a node by name
+type MetricsResponse map[string]int64
+
+// StoredVersion is one version a replica stores with the checksum it was stored with
+type StoredVersion struct {
+	Name string
+	Version int
+	Checksum string
+}
+
+// MerkleHashesRequest asks for nodes of the Merkle tree over the versions of Chunks a replica stores
+type MerkleHashesRequest struct {
+	Chunks []string
+	Level int
+	Indexes []int
+}
+
+type MerkleHashesResponse struct {
+	Hashes []string
+}
+
+type MerkleVersionsRequest struct {
+	Chunks []string
+	Leaves []int
+}
+
+type MerkleVersionsResponse struct {
+	Versions []StoredVersion
+}
@@ -0,0 +1,113 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// error codes, they tell callers what went wrong without parsing messages
+const (
+	// the file or version does not exist
+	NotFound = "not-found"
+	// a node did not answer in time
+	Timeout = "timeout"
+	// too few replicas answered or stored a write
+	QuorumNotMet = "quorum-not-met"
+	// the request clashes with the current state, e.g. a put of a version that is no longer the next one
+	Conflict = "conflict"
+	// no leader, no replica or no node to place a file on could be reached
+	Unavailable = "unavailable"
+	// the request itself is wrong
+	Invalid = "invalid"
+	// anything else
+	Internal = "internal"
+)
+
+var codes = []string{NotFound, Timeout, QuorumNotMet, Conflict, Unavailable, Invalid, Internal}
+
+// Error is an error with a code. net/rpc only carries the message of an error, so the message
+// starts with the code in brackets and Decode turns it back into an Error on the other side.
+type Error struct {
+	Code string
+	Message string
+	err error
+}
+
+func (e *Error) Error() string {
+	return "[" + e.Code + "] " + e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Errorf formats an error with a code, %w wraps like it does for fmt.Errorf
+func Errorf(code string, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+	return &Error{
+		Code: code,
+		Message: err.Error(),
+		err: errors.Unwrap(err),
+	}
+}
+
+// parses the code off the start of a message built by Error
+func parseCode(msg string) (string, string, bool) {
+	for _, code := range codes {
+		prefix := "[" + code + "] "
+		if strings.HasPrefix(msg, prefix) {
+			return code, msg[len(prefix):], true
+		}
+	}
+	return "", msg, false
+}
+
+// CodeOf returns the code of an error, also of one that crossed an rpc. Errors without a code
+// are classified by what they are: timeouts, unreachable nodes and redirects to an unknown leader.
+func CodeOf(err error) string {
+	if err == nil {
+		return ""
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Code
+	}
+	if code, _, ok := parseCode(err.Error()); ok {
+		return code
+	}
+	var unreachable *UnreachableError
+	if errors.As(err, &unreachable) && !errors.As(err, new(net.Error)) {
+		return Unavailable
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		if netErr.Timeout() {
+			return Timeout
+		}
+		return Unavailable
+	}
+	if _, ok := leaderHint(err); ok {
+		return Unavailable
+	}
+	return Internal
+}
+
+// Decode turns an error returned by an rpc back into an Error
+func Decode(err error) error {
+	if err == nil {
+		return nil
+	}
+	var e *Error
+	if errors.As(err, &e) {
+		return err
+	}
+	code := CodeOf(err)
+	_, msg, _ := parseCode(err.Error())
+	return &Error{
+		Code: code,
+		Message: msg,
+		err: err,
+	}
+}
@@ -0,0 +1,129 @@
+package common
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notLeaderPrefix = "not leader, leader is "
+)
+
+type LeaderRequest struct{}
+
+type LeaderResponse struct {
+	Leader string
+}
+
+// NotLeader is the error a coordinator candidate answers with when it is not the leader,
+// leader is the coordinator address it currently follows and may be empty
+func NotLeader(leader string) error {
+	return fmt.Errorf("%s[%s]", notLeaderPrefix, leader)
+}
+
+// parses the leader hint out of an error built by NotLeader, the error may have crossed an rpc
+func leaderHint(err error) (string, bool) {
+	msg := err.Error()
+	idx := strings.Index(msg, notLeaderPrefix)
+	if idx < 0 {
+		return "", false
+	}
+	return strings.Trim(msg[idx+len(notLeaderPrefix):], "[]"), true
+}
+
+// Coordinators tracks the coordinator candidates and which one of them currently leads,
+// so clients and replicas follow a failover without being reconfigured
+type Coordinators struct {
+	// coordinator rpc addresses (host:port)
+	Candidates []string
+	// how the candidates are reached
+	Transport Transport
+	leader string
+	mu sync.Mutex
+}
+
+func NewCoordinators(candidates []string) *Coordinators {
+	return &Coordinators{
+		Candidates: candidates,
+		Transport: DefaultTransport,
+	}
+}
+
+// SetLeader records the leader address learned from elsewhere, e.g. a failure detector ping
+func (cs *Coordinators) SetLeader(leader string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.leader = leader
+}
+
+// Leader returns the address of the current leader, asking the candidates if it is not known yet
+func (cs *Coordinators) Leader() string {
+	cs.mu.Lock()
+	leader := cs.leader
+	cs.mu.Unlock()
+	if leader != "" {
+		return leader
+	}
+	for _, candidate := range cs.Candidates {
+		resp := new(LeaderResponse)
+		if err := cs.Transport.Call(candidate, "Coordinator.Leader", &LeaderRequest{}, resp, time.Second); err != nil {
+			continue
+		}
+		if resp.Leader != "" {
+			cs.SetLeader(resp.Leader)
+			return resp.Leader
+		}
+	}
+	// nobody knows, let the caller try the first candidate
+	if len(cs.Candidates) > 0 {
+		return cs.Candidates[0]
+	}
+	return ""
+}
+
+// Call invokes method on the leader. Redirects from followers are followed and unreachable
+// leaders are replaced by asking the remaining candidates. Any other error is returned as is,
+// the leader may have handled the request and sending it again would apply it twice.
+func (cs *Coordinators) Call(method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	var err error
+	tried := map[string]struct{}{}
+	addr := cs.Leader()
+	for attempt := 0; attempt <= 2 * len(cs.Candidates); attempt++ {
+		tried[addr] = struct{}{}
+		err = cs.Transport.Call(addr, method, args, reply, timeout)
+		if err == nil {
+			return nil
+		}
+		hint, notLeader := leaderHint(err)
+		var unreachable *UnreachableError
+		if !notLeader && !errors.As(err, &unreachable) {
+			// an answer of the leader's own, or a timeout after the request went out
+			return err
+		}
+		cs.SetLeader("")
+		if hint != "" && hint != addr {
+			log.Printf("[%s] redirected [%s] to leader [%s]", addr, method, hint)
+			addr = hint
+			continue
+		}
+		// move on to a candidate that was not tried yet
+		next := ""
+		for _, candidate := range cs.Candidates {
+			if _, ok := tried[candidate]; !ok {
+				next = candidate
+				break
+			}
+		}
+		if next == "" {
+			break
+		}
+		addr = next
+		// give an election a moment to finish
+		time.Sleep(100 * time.Millisecond)
+	}
+	return err
+}
@@ -0,0 +1,76 @@
+package common
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/rpc"
+	"time"
+)
+
+// Transport carries rpcs between nodes. Every component calls other nodes through one,
+// so tests can swap in a transport that drops, delays or partitions traffic.
+type Transport interface {
+	// Call invokes method on the rpc server at addr and waits at most timeout for the reply
+	Call(addr string, method string, args interface{}, reply interface{}, timeout time.Duration) error
+}
+
+// RPCTransport is net/rpc over HTTP, what nodes use outside of tests
+type RPCTransport struct{}
+
+var DefaultTransport Transport = RPCTransport{}
+
+// Call dials the rpc server at addr, invokes method and waits at most timeout for the reply.
+// The deadline covers the dial too, so a server that accepts connections but hangs cannot block the caller.
+func (RPCTransport) Call(addr string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return &UnreachableError{addr, err}
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	// the handshake rpc.DialHTTP does, it has no way to take a deadline
+	io.WriteString(conn, "CONNECT " + rpc.DefaultRPCPath + " HTTP/1.0\n\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
+	if err == nil && resp.Status != "200 Connected to Go RPC" {
+		err = fmt.Errorf("unexpected HTTP response: %s", resp.Status)
+	}
+	if err != nil {
+		conn.Close()
+		// the request was not written yet
+		return &UnreachableError{addr, timedOut(err, method, addr, timeout)}
+	}
+	client := rpc.NewClient(conn)
+	defer client.Close()
+	return timedOut(client.Call(method, args, reply), method, addr, timeout)
+}
+
+// UnreachableError is a call that failed before the request was sent, so the callee never saw it
+// and the call is safe to send elsewhere. Any other error leaves open whether the callee handled it.
+type UnreachableError struct {
+	Addr string
+	Err error
+}
+
+func (e *UnreachableError) Error() string {
+	return fmt.Sprintf("[%s] is unreachable: %v", e.Addr, e.Err)
+}
+
+func (e *UnreachableError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is what a call that got no reply within timeout fails with
+func TimeoutError(method string, addr string, timeout time.Duration) error {
+	return Errorf(Timeout, "[%s] on [%s] timed out after %s", method, addr, timeout)
+}
+
+func timedOut(err error, method string, addr string, timeout time.Duration) error {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return TimeoutError(method, addr, timeout)
+	}
+	return err
+}
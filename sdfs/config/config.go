@@ -0,0 +1,295 @@
+package config
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/coordinator"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/replica"
+)
+
+const (
+	DefaultPath = "cluster.json"
+	DefaultMetaDir = "/tmp/sdfs-meta"
+	DefaultNumReplicas = 4
+	DefaultWriteQuorum = 3
+	DefaultReadQuorum = 2
+	DefaultPingPeriod = 3 * time.Second
+	DefaultPingTimeout = 1500 * time.Millisecond
+)
+
+// Duration reads durations written the way time.ParseDuration expects them, e.g. "1.5s"
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("durations must be strings like \"1.5s\": %w", err)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = parsed
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// Node is one sdfs process. Coordinator candidates serve the coordinator on Port,
+// every other node serves a replica on it.
+type Node struct {
+	Name string `json:"name"`
+	Address string `json:"address"`
+	Port int `json:"port"`
+	Coordinator bool `json:"coordinator"`
+	// where a replica stores files, defaults to a directory named after the node
+	DataDir string `json:"data_dir"`
+	// where a coordinator logs its metadata, defaults to a directory named after the node
+	MetaDir string `json:"meta_dir"`
+}
+
+func (n Node) Node() common.Node {
+	return common.Node{
+		Address: n.Address,
+		Port: n.Port,
+	}
+}
+
+// Cluster describes every node of an sdfs deployment and how it is tuned,
+// every node of the cluster is started with the same file
+type Cluster struct {
+	Nodes []Node `json:"nodes"`
+	NumReplicas int `json:"num_replicas"`
+	WriteQuorum int `json:"write_quorum"`
+	ReadQuorum int `json:"read_quorum"`
+	// gossip protocol period, one member is probed per period
+	PingPeriod Duration `json:"ping_period"`
+	// time a member has to answer a probe
+	PingTimeout Duration `json:"ping_timeout"`
+	// time a suspected member has to refute the suspicion before the gossip declares it dead
+	SuspicionTimeout Duration `json:"suspicion_timeout"`
+	// direct probes a dead node must miss in a row before the coordinator evicts it
+	SuspectProbes int `json:"suspect_probes"`
+	// minimum time a node stays suspected before the coordinator evicts it
+	EvictionGrace Duration `json:"eviction_grace"`
+	// metadata log entries between two snapshots
+	SnapshotInterval int `json:"snapshot_interval"`
+	// size files are split at, in bytes
+	ChunkSize int64 `json:"chunk_size"`
+	// time between two scrubs of a replica's chunks and the bytes per second a scrub reads
+	ScrubInterval Duration `json:"scrub_interval"`
+	ScrubRate int64 `json:"scrub_rate"`
+	// time between two anti-entropy rounds of a replica
+	AntiEntropyInterval Duration `json:"anti_entropy_interval"`
+	// time between two attempts of a replica to replay the hints it holds
+	HintReplayInterval Duration `json:"hint_replay_interval"`
+	// first delay before the coordinator retries work that failed, it doubles with every failure
+	RetryBackoff Duration `json:"retry_backoff"`
+}
+
+// Load reads the cluster file at path, fills in defaults for every missing setting and validates it
+func Load(path string) (*Cluster, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cluster := new(Cluster)
+	decoder := json.NewDecoder(f)
+	// a misspelled setting would otherwise silently fall back to its default
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(cluster); err != nil {
+		return nil, fmt.Errorf("could not parse [%s]: %w", path, err)
+	}
+	cluster.setDefaults()
+	if err := cluster.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid cluster file [%s]: %w", path, err)
+	}
+	return cluster, nil
+}
+
+func (c *Cluster) setDefaults() {
+	if c.NumReplicas == 0 {
+		c.NumReplicas = DefaultNumReplicas
+	}
+	if c.WriteQuorum == 0 {
+		c.WriteQuorum = DefaultWriteQuorum
+	}
+	if c.ReadQuorum == 0 {
+		c.ReadQuorum = DefaultReadQuorum
+	}
+	if c.PingPeriod.Duration == 0 {
+		c.PingPeriod.Duration = DefaultPingPeriod
+	}
+	if c.PingTimeout.Duration == 0 {
+		c.PingTimeout.Duration = DefaultPingTimeout
+	}
+	if c.SuspicionTimeout.Duration == 0 {
+		c.SuspicionTimeout.Duration = membership.DefaultSuspicionTimeout
+	}
+	if c.SuspectProbes == 0 {
+		c.SuspectProbes = coordinator.DefaultSuspectProbes
+	}
+	if c.EvictionGrace.Duration == 0 {
+		c.EvictionGrace.Duration = coordinator.DefaultEvictionGrace
+	}
+	if c.SnapshotInterval == 0 {
+		c.SnapshotInterval = coordinator.DefaultSnapshotInterval
+	}
+	if c.ChunkSize == 0 {
+		c.ChunkSize = common.DefaultChunkSize
+	}
+	if c.ScrubInterval.Duration == 0 {
+		c.ScrubInterval.Duration = replica.DefaultScrubInterval
+	}
+	if c.ScrubRate == 0 {
+		c.ScrubRate = replica.DefaultScrubRate
+	}
+	if c.AntiEntropyInterval.Duration == 0 {
+		c.AntiEntropyInterval.Duration = replica.DefaultAntiEntropyInterval
+	}
+	if c.HintReplayInterval.Duration == 0 {
+		c.HintReplayInterval.Duration = replica.DefaultHintReplayInterval
+	}
+	if c.RetryBackoff.Duration == 0 {
+		c.RetryBackoff.Duration = coordinator.DefaultRetryBackoff
+	}
+	for i := range c.Nodes {
+		n := &c.Nodes[i]
+		if n.Port == 0 {
+			n.Port = replica.DefaultPort
+			if n.Coordinator {
+				n.Port = coordinator.DefaultPort
+			}
+		}
+		if n.DataDir == "" {
+			n.DataDir = filepath.Join(replica.DefaultDataDir, n.Name)
+		}
+		if n.MetaDir == "" {
+			n.MetaDir = filepath.Join(DefaultMetaDir, n.Name)
+		}
+	}
+}
+
+// Validate checks the cluster can run: names and rpc addresses are unique, nodes sharing a host
+// do not share directories, there is a coordinator candidate and the quorums fit the replica count
+func (c *Cluster) Validate() error {
+	if len(c.Nodes) == 0 {
+		return fmt.Errorf("no nodes")
+	}
+	names := map[string]struct{}{}
+	addrs := map[string]string{}
+	dirs := map[string]string{}
+	candidates := 0
+	replicas := 0
+	for _, n := range c.Nodes {
+		if n.Name == "" {
+			return fmt.Errorf("node [%s] has no name", n.Node().Addr())
+		}
+		if _, ok := names[n.Name]; ok {
+			return fmt.Errorf("node name [%s] is used twice", n.Name)
+		}
+		names[n.Name] = struct{}{}
+		if n.Address == "" {
+			return fmt.Errorf("node [%s] has no address", n.Name)
+		}
+		if n.Port < 1 || n.Port > 65535 {
+			return fmt.Errorf("node [%s] has invalid port [%d]", n.Name, n.Port)
+		}
+		addr := n.Node().Addr()
+		if other, ok := addrs[addr]; ok {
+			return fmt.Errorf("nodes [%s] and [%s] both use [%s]", other, n.Name, addr)
+		}
+		addrs[addr] = n.Name
+		dir := n.DataDir
+		if n.Coordinator {
+			dir = n.MetaDir
+			candidates += 1
+		} else {
+			replicas += 1
+		}
+		key := n.Address + ":" + filepath.Clean(dir)
+		if other, ok := dirs[key]; ok {
+			return fmt.Errorf("nodes [%s] and [%s] on [%s] both use directory [%s]", other, n.Name, n.Address, dir)
+		}
+		dirs[key] = n.Name
+	}
+	if candidates == 0 {
+		return fmt.Errorf("no coordinator candidate")
+	}
+	if c.NumReplicas < 1 {
+		return fmt.Errorf("num_replicas must be at least 1, got %d", c.NumReplicas)
+	}
+	if c.WriteQuorum < 1 || c.WriteQuorum > c.NumReplicas || c.ReadQuorum < 1 || c.ReadQuorum > c.NumReplicas {
+		return fmt.Errorf("quorums must be between 1 and %d, got W=%d R=%d", c.NumReplicas, c.WriteQuorum, c.ReadQuorum)
+	}
+	if c.WriteQuorum + c.ReadQuorum <= c.NumReplicas {
+		log.Printf("W=%d + R=%d <= N=%d, gets may not see the latest put", c.WriteQuorum, c.ReadQuorum, c.NumReplicas)
+	}
+	if replicas < c.NumReplicas {
+		log.Printf("only [%d] replica nodes for [%d] replicas of every file", replicas, c.NumReplicas)
+	}
+	if c.PingPeriod.Duration <= 0 || c.PingTimeout.Duration <= 0 || c.SuspicionTimeout.Duration <= 0 || c.EvictionGrace.Duration < 0 {
+		return fmt.Errorf("ping_period, ping_timeout and suspicion_timeout must be positive, eviction_grace must not be negative")
+	}
+	if c.PingTimeout.Duration >= c.PingPeriod.Duration {
+		return fmt.Errorf("ping_timeout [%s] must be shorter than ping_period [%s]", c.PingTimeout, c.PingPeriod)
+	}
+	if c.SuspectProbes < 1 {
+		return fmt.Errorf("suspect_probes must be at least 1, got %d", c.SuspectProbes)
+	}
+	if c.SnapshotInterval < 0 {
+		return fmt.Errorf("snapshot_interval must not be negative, got %d", c.SnapshotInterval)
+	}
+	if c.ChunkSize < 0 {
+		return fmt.Errorf("chunk_size must be positive, got %d", c.ChunkSize)
+	}
+	if c.ScrubInterval.Duration < 0 || c.ScrubRate < 0 || c.AntiEntropyInterval.Duration < 0 || c.HintReplayInterval.Duration < 0 {
+		return fmt.Errorf("scrub_interval, scrub_rate, anti_entropy_interval and hint_replay_interval must not be negative")
+	}
+	if c.RetryBackoff.Duration < 0 {
+		return fmt.Errorf("retry_backoff must be positive, got %s", c.RetryBackoff)
+	}
+	return nil
+}
+
+// Node looks up a node by name
+func (c *Cluster) Node(name string) (Node, bool) {
+	for _, n := range c.Nodes {
+		if n.Name == name {
+			return n, true
+		}
+	}
+	return Node{}, false
+}
+
+// Candidates are the rpc addresses of the coordinator candidates
+func (c *Cluster) Candidates() []string {
+	output := []string{}
+	for _, n := range c.Nodes {
+		if n.Coordinator {
+			output = append(output, n.Node().Addr())
+		}
+	}
+	return output
+}
+
+// Membership is the gossip tuning every node runs with
+func (c *Cluster) Membership() membership.Config {
+	config := membership.DefaultConfig()
+	config.ProtocolPeriod = c.PingPeriod.Duration
+	config.PingTimeout = c.PingTimeout.Duration
+	config.SuspicionTimeout = c.SuspicionTimeout.Duration
+	return config
+}
@@ -1,16 +1,20 @@
 package coordinator
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/serialx/hashring"
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
 )
 
 const (
@@ -19,201 +23,730 @@ const (
 	ReplicaPort = 60221
 	FileTransmissionPort = 60223
 	RequestTimeout = 1 * time.Second
+	ReplicationTimeout = 5 * time.Minute
+	// a commit without data prepares and then commits or rolls back on the replicas, and logs the
+	// result, which takes up to three rounds of requests to a follower that needs the snapshot
+	CommitTimeout = 2 * RequestTimeout + 3 * RequestTimeout + time.Second
+	// a put whose client did not renew its reservation for this long gives its version up to the next put,
+	// clients renew while their blocks make progress
+	UploadLease = 30 * time.Second
 )
 
 type Coordinator struct {
 	Self common.Node
 	NumReplicas int
+	// number of replicas that must store a put before it succeeds
+	WriteQuorum int
+	// number of replicas a get consults for the newest version
+	ReadQuorum int
 	Nodes map[string]common.Node
 	Files map[string]common.FileGroup
 	Ring *hashring.HashRing
-	pingPeriod time.Duration
+	// gossip membership shared with every replica, it decides which nodes failed
+	Membership *membership.Membership
+	// how replicas and the other candidates are reached
+	Transport common.Transport
 	RequestTimeout time.Duration
+	// confirmation a node the gossip declared dead needs before it is evicted: this many missed
+	// direct probes in a row, spread over at least EvictionGrace
+	SuspectProbes int
+	EvictionGrace time.Duration
+	// size files are split at, only new versions pick up a change
+	ChunkSize int64
+	Counters *metrics.Counters
+	// guards Nodes, Files, Ring, Retries and the write-ahead log, it is never held while talking to replicas
+	// or the other candidates
+	mu sync.RWMutex
+	// serializes what the leader sends to followers so they see entries in order, taken before mu
+	appendMu sync.Mutex
+	wal *WAL
+	// entries in the write-ahead log that are not known to be committed yet, in order. They are applied
+	// once the leader's commit index passes them, or replaced by a snapshot of the leader.
+	pending []LogEntry
+	// index and term of the last applied entry
+	applied int
+	appliedTerm int
+	election *election
+	// serializes puts, deletes and re-replication of the same file
+	fileLocks map[string]*fileLock
+	fileLocksMu sync.Mutex
+	// puts the leader reserved a version for that did not commit yet, by file name
+	uploads map[string]upload
+	uploadsMu sync.Mutex
+	// serializes membership changes so only one rebalance runs at a time
+	membershipMu sync.Mutex
+	// corrupt or missing copies waiting to be replaced, each copy is queued at most once
+	repairs chan common.CorruptionReport
+	pendingRepairs map[string]struct{}
+	repairsMu sync.Mutex
+	// first delay before failed work is retried
+	RetryBackoff time.Duration
+	// failed work waiting to be retried by task key, logged like the rest of the metadata
+	// so a new leader picks it up
+	Retries map[string]RetryTask
+	// serializes changes to Retries so each piece of work is queued at most once
+	retriesMu sync.Mutex
+	// closed to stop the background loops
+	stop chan struct{}
+	stopMu sync.Mutex
 }
 
+type upload struct {
+	id string
+	version int
+	renewed time.Time
+	// the client asked to commit, the upload is held until the commit finishes
+	committing bool
+}
+
+type fileLock struct {
+	sync.Mutex
+	refs int
+}
 
-func NewCoordinator(self common.Node, numReplicas int, nodes map[string]common.Node, pingPeriod time.Duration, requestTimeout time.Duration) *Coordinator {
+
+// candidates are the rpc addresses of every coordinator candidate, including this one
+func NewCoordinator(self common.Node, numReplicas int, writeQuorum int, readQuorum int, nodes map[string]common.Node, candidates []string, members *membership.Membership, requestTimeout time.Duration) *Coordinator {
 	nodeAddresses := []string{}
 	for addr := range nodes {
 		nodeAddresses = append(nodeAddresses, addr)
 	}
+	selfAddr := self.Addr()
+	peers := []string{}
+	for _, candidate := range candidates {
+		if candidate != selfAddr {
+			peers = append(peers, candidate)
+		}
+	}
  
 	return &Coordinator{
 		Self: self,
 		NumReplicas: numReplicas,
+		WriteQuorum: writeQuorum,
+		ReadQuorum: readQuorum,
 		Nodes: nodes,
-		pingPeriod: pingPeriod,
+		Membership: members,
+		Transport: common.DefaultTransport,
 		RequestTimeout: requestTimeout,
+		SuspectProbes: DefaultSuspectProbes,
+		EvictionGrace: DefaultEvictionGrace,
+		ChunkSize: common.DefaultChunkSize,
+		Counters: metrics.New(),
 		Ring: hashring.New(nodeAddresses),
 		Files: map[string]common.FileGroup{},
+		fileLocks: map[string]*fileLock{},
+		uploads: map[string]upload{},
+		repairs: make(chan common.CorruptionReport, RepairQueueSize),
+		pendingRepairs: map[string]struct{}{},
+		RetryBackoff: DefaultRetryBackoff,
+		Retries: map[string]RetryTask{},
+		election: &election{
+			self: selfAddr,
+			peers: peers,
+		},
 	}
 }
 
-func (c *Coordinator) ping() []common.Node {
-	wg := sync.WaitGroup{}
-	failures := make(chan common.Node, CoordinatorBufferSize)
-	for _, node := range c.Nodes {
-		if node.Address == c.Self.Address {
-			continue;
+// locks a single file and returns the function that unlocks it
+func (c *Coordinator) lockFile(name string) func() {
+	c.fileLocksMu.Lock()
+	l, ok := c.fileLocks[name]
+	if !ok {
+		l = &fileLock{}
+		c.fileLocks[name] = l
+	}
+	l.refs += 1
+	c.fileLocksMu.Unlock()
+
+	l.Lock()
+	return func() {
+		l.Unlock()
+		c.fileLocksMu.Lock()
+		l.refs -= 1
+		if l.refs == 0 {
+			delete(c.fileLocks, name)
 		}
-		wg.Add(1)
-		go func(wg *sync.WaitGroup, node common.Node) {
-			client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", node.Address, node.Port))
-			if err != nil {
-				failures <- node
-				log.Println("dialing:", err)
-			} else {
-				ack := new(common.FDAck)
-				ping := new(common.FDPing)
-				call := client.Go("Replica.FDAck", &ping, &ack, nil)
-				select {
-				case <- call.Done:
-					break
-				case <- time.After(c.RequestTimeout):
-					log.Printf("ping not acked within timeout at %s", node.Address)
-					failures <- node
-				}
-			}
-			wg.Done()
-		}(&wg, node)
+		c.fileLocksMu.Unlock()
 	}
-	wg.Wait()
-	close(failures)
-	output := []common.Node{}
-	for f := range failures {
-		output = append(output, f)
+}
+
+// returns a copy of the membership list
+func (c *Coordinator) nodes() map[string]common.Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nodes := map[string]common.Node{}
+	for addr, node := range c.Nodes {
+		nodes[addr] = node
 	}
-	return output
+	return nodes
 }
 
-// retruns a set of replicas for a file in a ring
-func (c* Coordinator) getReplicasForFile(file string, ring *hashring.HashRing) (string, map[string]struct{}) {
-	replicas, ok := ring.GetNodes(file, c.NumReplicas)
-	if !ok {
-		log.Panicf("could not get replicas for [%s], ring [%d]", file, ring.Size())
+// Lookup returns the file group of a file as this coordinator applied it, a follower may lag the leader
+func (c *Coordinator) Lookup(name string) (common.FileGroup, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fg, ok := c.Files[name]
+	return fg, ok
+}
+
+// retruns a set of replicas for a file in a ring. A ring with fewer nodes than NumReplicas
+// places the file on every node it has.
+func (c* Coordinator) getReplicasForFile(file string, ring *hashring.HashRing) (string, map[string]struct{}, error) {
+	n := c.NumReplicas
+	if ring.Size() < n {
+		n = ring.Size()
+	}
+	replicas, ok := ring.GetNodes(file, n)
+	if !ok || len(replicas) == 0 {
+		return "", nil, common.Errorf(common.Unavailable, "could not get replicas for [%s], ring [%d]: %w", file, ring.Size(), ErrNoNodes)
 	}
 	output := map[string]struct{}{}
 	for _, r := range replicas {
 		output[r] = struct{}{}
 	}
-	return replicas[0], output
+	return replicas[0], output, nil
 }
 
-func (c *Coordinator) sendReplication(rep common.Replication) {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", rep.Source, ReplicaPort))
-	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		ack := new(common.ReplicationSentAck)
-		call := client.Go("Replica.SendReplication", &rep, &ack, nil)
-		select {
-		case <- call.Done:
-			return
-		case <- time.After(RequestTimeout):
-			log.Panicln("could not send replication")
+// asks the source to copy every version of the file group to the destination. The copy can take
+// minutes, so it is not retried here.
+func (c *Coordinator) sendReplication(rep common.Replication) error {
+	ack := new(common.ReplicationSentAck)
+	if err := c.Transport.Call(rep.Source, "Replica.SendReplication", &rep, ack, ReplicationTimeout); err != nil {
+		return &CallError{"Replica.SendReplication", rep.Source, err}
+	}
+	return nil
+}
+
+// asks the destination to confirm it now holds the file group
+func (c *Coordinator) receiveReplication(rep common.Replication) error {
+	ack := new(common.ReplicationReceivedAck)
+	return c.call(rep.Destination, "Replica.ReceiveReplication", &rep, ack, RequestTimeout)
+}
+
+func (c *Coordinator) replicate(rep common.Replication) error {
+	if err := c.sendReplication(rep); err != nil {
+		return err
+	}
+	return c.receiveReplication(rep)
+}
+
+// copies every file group onto the replicas the ring assigns it and logs the groups whose replica set changed.
+// Files are handled one at a time under their file lock, so puts of other files keep going meanwhile.
+// A file that cannot be moved now is queued for a retry, the others are moved regardless.
+func (c *Coordinator) diff() {
+	log.Println("calculating diff between pre-replicated and post-replicated state")
+	c.mu.RLock()
+	names := []string{}
+	for f := range c.Files {
+		names = append(names, f)
+	}
+	c.mu.RUnlock()
+
+	// compare the ring with the current file distribution
+	for _, f := range names {
+		if err := c.rebalanceFile(f); err != nil {
+			c.retryRebalance(f, err)
 		}
 	}
 }
 
-func (c *Coordinator) receiveReplication(rep common.Replication) {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", rep.Destination, ReplicaPort))
-	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		ack := new(common.ReplicationSentAck)
-		call := client.Go("Replica.ReceiveReplication", &rep, &ack, nil)
-		select {
-		case <- call.Done:
-			return
-		case <- time.After(RequestTimeout):
-			log.Panicln("could not receive replication")
+// moves every chunk of a file onto the replicas the ring assigns it and logs the new placement.
+// Chunks that could not be copied everywhere keep the copies they have, the first such failure is returned.
+func (c *Coordinator) rebalanceFile(f string) error {
+	unlock := c.lockFile(f)
+	defer unlock()
+	c.mu.RLock()
+	fg, ok := c.Files[f]
+	ring := c.Ring
+	c.mu.RUnlock()
+	if !ok {
+		// deleted in the meantime
+		return nil
+	}
+	nodes := c.nodes()
+	fg = fg.Clone()
+
+	changed := false
+	// chunk name -> nodes whose copy of it is no longer needed
+	dropped := map[string][]string{}
+	var failed error
+	for i := range fg.Chunks {
+		name := common.ChunkName(f, i)
+		version := fg.ChunkVersion(i)
+		if version == 0 {
+			continue
+		}
+		replicas, drop, err := c.rebalanceChunk(name, version, chunkChecksums(fg, i), fg.Chunks[i].Replicas, nodes, ring)
+		if err != nil && failed == nil {
+			failed = err
+		}
+		if len(drop) > 0 {
+			dropped[name] = drop
+		}
+		if !sameReplicas(replicas, fg.Chunks[i].Replicas) {
+			fg.Chunks[i].Replicas = replicas
+			changed = true
+		}
+	}
+	if !changed {
+		return failed
+	}
+	fg.Replicas = chunkReplicas(fg.Chunks)
+	if err := c.commit(LogEntry{Type: ReplicationEntry, File: fg}); err != nil {
+		return err
+	}
+	for name, addrs := range dropped {
+		for _, r := range addrs {
+			c.dropReplica(r, name)
 		}
 	}
+	return failed
 }
 
-func (c *Coordinator) diff(newRing *hashring.HashRing) map[string]common.FileGroup {
-	log.Println("calculating diff between pre-replicated and post-replicated state")
-	output := map[string]common.FileGroup{}
-	// compare newRing with the current file distribution
-	// return the new file distribution
-	for f, fg := range c.Files {
-		// get replicas on new hashring
-		_, newReplicas := c.getReplicasForFile(f, newRing)
-
-		// get replicas on old hashring
-		src, oldReplicas := c.getReplicasForFile(f, c.Ring)
-		
-		for r := range newReplicas {
-			_, inOld := oldReplicas[r]
-			if !inOld {
-				log.Printf("[%s] replication: [%s] -> [%s]", f, src, r)
-				fg.Replicas = newReplicas
-				c.sendReplication(common.Replication{
-					Destination: r,
-					FileGroup: fg,
-					Source: src,
-				})
-				c.receiveReplication(common.Replication{
-					Destination: r,
-					FileGroup: fg,
-					Source: src,
-				})
+// copies one chunk onto the replicas the ring assigns it, returns the replicas now holding it,
+// the ones that can drop their copy and why a replica could not get a copy
+func (c *Coordinator) rebalanceChunk(name string, version int, checksums map[int]string, current common.AddressSet, nodes map[string]common.Node, ring *hashring.HashRing) (common.AddressSet, []string, error) {
+	// get replicas on new hashring
+	_, newReplicas, err := c.getReplicasForFile(name, ring)
+	if err != nil {
+		return current, nil, err
+	}
+
+	// the replicas that are still alive keep their copy, any of them can be the source
+	replicas := common.AddressSet{}
+	sources := []string{}
+	for r := range current {
+		if _, alive := nodes[r]; alive {
+			replicas[r] = struct{}{}
+			sources = append(sources, r)
+		}
+	}
+
+	if len(sources) == 0 {
+		// keep the old replica set, the chunk comes back if one of them does
+		log.Printf("[%s] has no surviving replica to copy from", name)
+		return current, nil, nil
+	}
+
+	var failed error
+	for r := range newReplicas {
+		if _, has := replicas[r]; has {
+			continue
+		}
+		// a source whose copy fails its checksum refuses to send it, the next one is tried
+		var err error
+		for _, src := range sources {
+			log.Printf("[%s] replication: [%s] -> [%s]", name, src, r)
+			err = c.replicate(common.Replication{
+				Destination: r,
+				FileGroup: common.FileGroup{
+					Name: name,
+					Version: version,
+				},
+				Source: src,
+				Checksums: checksums,
+			})
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			// leave the destination out so the replica set only names nodes holding the data
+			log.Printf("[%s] replication to [%s] failed: %v", name, r, err)
+			if failed == nil {
+				failed = err
 			}
-			output[f] = fg
+			continue
 		}
+		replicas[r] = struct{}{}
 	}
 
+	// once every replica the ring assigns holds a copy, the others are no longer needed
+	dropped := []string{}
+	for r := range newReplicas {
+		if _, has := replicas[r]; !has {
+			return replicas, nil, failed
+		}
+	}
+	for r := range replicas {
+		if _, ok := newReplicas[r]; !ok {
+			dropped = append(dropped, r)
+			delete(replicas, r)
+		}
+	}
+	return replicas, dropped, nil
+}
+
+// checksums of every version of a chunk, versions put without one are left out
+func chunkChecksums(fg common.FileGroup, index int) map[int]string {
+	output := map[int]string{}
+	for version, manifest := range fg.Manifests {
+		if index < len(manifest.Chunks) && manifest.Chunks[index].Checksum != "" {
+			output[version] = manifest.Chunks[index].Checksum
+		}
+	}
 	return output
 }
 
-func (c *Coordinator) handleFailure(failed common.Node) {
-	log.Printf("detected failure at [%s]", failed.Address)
-	// remove node from node map
-	delete(c.Nodes, failed.Address)
-	// remove node from hashring
-	removed := c.Ring.RemoveNode(failed.Address)
-	
+func sameReplicas(a common.AddressSet, b common.AddressSet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for r := range a {
+		if _, ok := b[r]; !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// every replica holding at least one chunk
+func chunkReplicas(chunks []common.Chunk) common.AddressSet {
+	output := common.AddressSet{}
+	for _, chunk := range chunks {
+		for r := range chunk.Replicas {
+			output[r] = struct{}{}
+		}
+	}
+	return output
+}
+
+// places the chunks of a file the file group has no placement for yet on the ring,
+// chunks that already have replicas stay where they are
+func (c *Coordinator) placeChunks(fg common.FileGroup, n int, ring *hashring.HashRing) (common.FileGroup, error) {
+	for i := len(fg.Chunks); i < n; i++ {
+		_, replicas, err := c.getReplicasForFile(common.ChunkName(fg.Name, i), ring)
+		if err != nil {
+			return fg, err
+		}
+		fg.Chunks = append(fg.Chunks, common.Chunk{Replicas: replicas})
+	}
+	fg.Replicas = chunkReplicas(fg.Chunks)
+	return fg, nil
+}
+
+// number of chunks a file of the given size is split into, even an empty file has one
+func (c *Coordinator) numChunks(size int64) int {
+	if size <= c.ChunkSize {
+		return 1
+	}
+	return int((size + c.ChunkSize - 1) / c.ChunkSize)
+}
+
+// deletes the copy of a file a node holds after the file moved off it, a failed delete is retried later
+func (c *Coordinator) dropReplica(addr string, name string) {
+	log.Printf("[%s] moved off [%s], deleting its copy", name, addr)
+	update := common.FileUpdate{
+		Name: name,
+		OpType: common.DeleteFileOp,
+	}
+	if err := c.call(addr, "Replica.ReceiveFileUpdate", &update, new(struct{}), RequestTimeout); err != nil {
+		log.Printf("could not delete [%s] from [%s]: %v", name, addr, err)
+		c.retryUpdate(addr, "Replica.ReceiveFileUpdate", update, err)
+	}
+}
+
+// logs a join, leave or failure as one ring change and moves every file the change affects in one pass.
+// Only logging the change can fail, files that cannot be moved right away are moved by the retry queue.
+func (c *Coordinator) changeMembership(entry LogEntry) error {
+	c.membershipMu.Lock()
+	defer c.membershipMu.Unlock()
+	// update node map and hashring
+	if err := c.commit(entry); err != nil {
+		return err
+	}
+
 	// calculate and log the differences between the old ring and new ring
 	// send ReplicationReceived and ReplicationSent requests
-	c.Files = c.diff(removed)
+	c.diff()
+	return nil
+}
 
-	c.Ring = removed
+// handles every failure detected in a round together
+func (c *Coordinator) handleFailures(failed []common.Node) {
+	addrs := []string{}
+	for _, node := range failed {
+		addrs = append(addrs, node.Addr())
+	}
+	log.Printf("detected failure at %v", addrs)
+	if err := c.changeMembership(LogEntry{Type: FailureEntry, Nodes: failed}); err != nil {
+		log.Printf("could not record failure of %v: %v", addrs, err)
+	}
 }
 
-func (c *Coordinator) sendFileUpdate(addr string, update common.FileUpdate) {
-	client, err := rpc.DialHTTP("tcp", fmt.Sprintf("%s:%d", addr, ReplicaPort))
+// applies a metadata change to the in-memory state
+func (c *Coordinator) apply(entry LogEntry) {
+	switch entry.Type {
+	case PutEntry, ReplicationEntry:
+		c.Files[entry.File.Name] = entry.File
+	case DeleteEntry:
+		delete(c.Files, entry.File.Name)
+	case JoinEntry:
+		if _, ok := c.Nodes[entry.Node.Addr()]; !ok {
+			c.Ring = c.Ring.AddNode(entry.Node.Addr())
+		}
+		c.Nodes[entry.Node.Addr()] = entry.Node
+	case LeaveEntry:
+		delete(c.Nodes, entry.Node.Addr())
+		c.Ring = c.Ring.RemoveNode(entry.Node.Addr())
+	case FailureEntry:
+		for _, node := range entry.Nodes {
+			delete(c.Nodes, node.Addr())
+			c.Ring = c.Ring.RemoveNode(node.Addr())
+		}
+	case RetryEntry:
+		c.Retries[entry.Retry.key()] = entry.Retry
+	case RetryDoneEntry:
+		delete(c.Retries, entry.Retry.key())
+	}
+}
+
+// writes a metadata change to the write-ahead log, sends every entry not committed yet to the other
+// candidates and applies them once a majority logged them. An entry that does not reach a majority keeps
+// its index and is sent again with every heartbeat. The leader serves no requests until a majority has it,
+// so nothing is built on top of it before it is applied.
+func (c *Coordinator) commit(entry LogEntry) error {
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+	c.election.mu.Lock()
+	role, ready, term, leader := c.election.role, c.election.ready, c.election.Term, c.election.leader
+	c.election.mu.Unlock()
+	// only the entry a new leader takes over with is committed before the leader is ready
+	if role != Leader || (!ready && entry.Type != NoopEntry) {
+		return common.NotLeader(leader)
+	}
+
+	c.mu.Lock()
+	entry.Term = term
+	entry.Index = c.wal.Index + 1
+	if err := c.wal.Append(&entry); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.pending = append(c.pending, entry)
+	prevIndex, prevTerm, entries := c.applied, c.appliedTerm, append([]LogEntry{}, c.pending...)
+	c.mu.Unlock()
+	if !c.replicateLog(term, prevIndex, prevTerm, entries) {
+		c.stopServing(term, entry.Index)
+		return common.Errorf(common.Unavailable, "entry [%d] did not reach a majority of coordinators", entry.Index)
+	}
+	if !c.applyReplicated(entry) {
+		return common.Errorf(common.Unavailable, "lost leadership while committing entry [%d]", entry.Index)
+	}
+	return nil
+}
+
+// applies the pending entries up to entry once a majority logged them, unless a newer leader replaced
+// them meanwhile
+func (c *Coordinator) applyReplicated(entry LogEntry) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if n := len(c.pending); n == 0 || c.pending[n-1].Index != entry.Index || c.pending[n-1].Term != entry.Term {
+		return false
+	}
+	c.applyUpTo(entry.Index)
+	return true
+}
+
+// applies the pending entries up to index, which a majority of candidates logged. Must be called with c.mu held.
+func (c *Coordinator) applyUpTo(index int) {
+	for len(c.pending) > 0 && c.pending[0].Index <= index {
+		entry := c.pending[0]
+		c.pending = c.pending[1:]
+		c.apply(entry)
+		c.applied, c.appliedTerm = entry.Index, entry.Term
+	}
+	// a snapshot holds applied state only
+	if len(c.pending) == 0 && c.wal.ShouldSnapshot() {
+		if err := c.wal.Snapshot(c.Files, c.Nodes, c.Retries); err != nil {
+			log.Printf("could not snapshot metadata: %v", err)
+		}
+	}
+}
+
+// the metadata at the last applied entry, the maps are copies so the snapshot can be sent without
+// holding c.mu. Must be called with c.mu held for reading at least.
+func (c *Coordinator) snapshot() Snapshot {
+	snap := Snapshot{
+		Index: c.applied,
+		Term: c.appliedTerm,
+		Files: make(map[string]common.FileGroup, len(c.Files)),
+		Nodes: make(map[string]common.Node, len(c.Nodes)),
+		Retries: make(map[string]RetryTask, len(c.Retries)),
+	}
+	for name, fileGroup := range c.Files {
+		snap.Files[name] = fileGroup
+	}
+	for addr, node := range c.Nodes {
+		snap.Nodes[addr] = node
+	}
+	for key, t := range c.Retries {
+		snap.Retries[key] = t
+	}
+	return snap
+}
+
+// replaces the metadata with a snapshot
+func (c *Coordinator) restore(snap Snapshot) {
+	c.applied, c.appliedTerm = snap.Index, snap.Term
+	c.Files = snap.Files
+	c.Nodes = snap.Nodes
+	c.Retries = snap.Retries
+	if c.Retries == nil {
+		// snapshots taken before retries were logged
+		c.Retries = map[string]RetryTask{}
+	}
+	nodeAddresses := []string{}
+	for addr := range c.Nodes {
+		nodeAddresses = append(nodeAddresses, addr)
+	}
+	c.Ring = hashring.New(nodeAddresses)
+}
+
+// Recover rebuilds the metadata from the snapshot in dir and logs every later change there. The entries
+// logged after the snapshot may not have been committed, they are applied once a leader commits them.
+func (c *Coordinator) Recover(dir string, snapshotInterval int) error {
+	wal, snap, entries, err := OpenWAL(dir, snapshotInterval)
 	if err != nil {
-		log.Println("dialing:", err)
-	} else {
-		ack := new(common.PutAck)
-		call := client.Go("Replica.ReceiveFileUpdate", &update, &ack, nil)
-		select {
-		case <- call.Done:
-			return
-		case <- time.After(RequestTimeout):
-			log.Panicln("could not send replication")
+		return err
+	}
+	c.restore(snap)
+	c.pending = entries
+	c.wal = wal
+	c.election.dir = dir
+	if err := c.election.load(); err != nil {
+		return err
+	}
+	log.Printf("recovered [%d] files and [%d] nodes from [%s] at index [%d], term [%d], [%d] queued retries, [%d] entries to commit", len(c.Files), len(c.Nodes), dir, snap.Index, c.election.Term, len(c.Retries), len(entries))
+	return nil
+}
+
+// one replica taking part in a two-phase commit and the update it applies, a replica holding
+// several chunks of a file takes part once per chunk
+type participant struct {
+	addr string
+	update common.FileUpdate
+}
+
+// PutCommitTimeout is how long committing a put of chunks of up to chunkSize bytes may take, the replicas
+// flush every chunk to disk when they prepare it
+func PutCommitTimeout(chunkSize int64) time.Duration {
+	return CommitTimeout + 2 * (common.FlushTimeout(RequestTimeout, chunkSize) - RequestTimeout)
+}
+
+// sends one phase of a two-phase commit to a replica, the replica may have to flush the chunk to disk
+func (c *Coordinator) sendFileUpdate(addr string, method string, update common.FileUpdate) error {
+	return c.Transport.Call(addr, method, &update, new(struct{}), common.FlushTimeout(RequestTimeout, update.Size))
+}
+
+// a participant that failed a phase and why
+type phaseFailure struct {
+	participant
+	err error
+}
+
+// sends one phase to every participant in parallel and returns the participants that failed it
+func (c *Coordinator) broadcastPhase(participants []participant, method string) []phaseFailure {
+	wg := sync.WaitGroup{}
+	failures := make(chan phaseFailure, len(participants))
+	for _, p := range participants {
+		wg.Add(1)
+		go func(p participant) {
+			defer wg.Done()
+			if err := c.sendFileUpdate(p.addr, method, p.update); err != nil {
+				log.Printf("[%s] of [%s] version [%d] failed on [%s]: %v", method, p.update.Name, p.update.Version, p.addr, err)
+				failures <- phaseFailure{p, &CallError{method, p.addr, err}}
+			}
+		}(p)
+	}
+	wg.Wait()
+	close(failures)
+	failed := []phaseFailure{}
+	for f := range failures {
+		failed = append(failed, f)
+	}
+	return failed
+}
+
+// the code a failed phase is reported with: what a replica answered with if it said what is wrong
+// with the update, e.g. a checksum mismatch or a pending delete, unavailable if replicas did not answer
+func phaseCode(failed []phaseFailure) string {
+	for _, f := range failed {
+		var cerr *CallError
+		if !errors.As(f.err, &cerr) || cerr.Temporary() {
+			continue
+		}
+		if code := common.CodeOf(cerr.Err); code != common.Internal {
+			return code
+		}
+	}
+	return common.Unavailable
+}
+
+func describe(failed []phaseFailure) []string {
+	output := []string{}
+	for _, f := range failed {
+		output = append(output, f.update.Name + " on " + f.addr)
+	}
+	return output
+}
+
+// tells every participant to throw the update away, the ones that cannot be reached are told later
+// so they do not keep a prepared version or a pending delete around
+func (c *Coordinator) rollback(participants []participant) {
+	for _, f := range c.broadcastPhase(participants, "Replica.Rollback") {
+		c.retryUpdate(f.addr, "Replica.Rollback", f.update, f.err)
+	}
+}
+
+// runs prepare/commit across the participants. The update only commits if every participant
+// prepared it within the timeout, otherwise every participant is told to roll back.
+func (c *Coordinator) twoPhaseCommit(name string, version int, participants []participant) error {
+	if failed := c.broadcastPhase(participants, "Replica.Prepare"); len(failed) > 0 {
+		c.rollback(participants)
+		return common.Errorf(phaseCode(failed), "[%s] version [%d] was not prepared by %v, rolled back: %w", name, version, describe(failed), failed[0].err)
+	}
+	// the decision is made, replicas that miss the commit still hold the prepared version and get it again later
+	if failed := c.broadcastPhase(participants, "Replica.Commit"); len(failed) > 0 {
+		log.Printf("[%s] version [%d] committed, but commit did not reach %v", name, version, describe(failed))
+		for _, f := range failed {
+			c.retryUpdate(f.addr, "Replica.Commit", f.update, f.err)
 		}
 	}
+	return nil
 }
 
 func (c *Coordinator) Ls(req *common.LsRequest, resp *common.LsResponse) error {
-	fg, exists := c.Files[req.Filename]
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	fg, exists := c.Lookup(req.Filename)
 	*resp = common.LsResponse{
 		Addresses: []string{},
+		Chunks: [][]string{},
 	}
 	if !exists {
 		return nil
 	}
+	resp.Version = fg.Version
+	resp.ReadQuorum = c.ReadQuorum
 	for machine := range fg.Replicas {
 		resp.Addresses = append(resp.Addresses, machine)
 	}
+	resp.Chunks = fg.ChunkReplicas()
+	resp.Manifest = fg.Manifests[fg.Version]
 	return nil
 }
 
 func (c *Coordinator) Store(req *common.StoreRequest, resp *common.StoreResponse) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
 	*resp = common.StoreResponse{
 		Files: []string{},
 	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
 	for f, fg := range c.Files {
 		_, ok := fg.Replicas[req.Address]
 		if ok {
@@ -224,60 +757,96 @@ func (c *Coordinator) Store(req *common.StoreRequest, resp *common.StoreResponse
 }
 
 func (c *Coordinator) MemList(req *common.MemListRequest, resp *common.MemListResponse) error {
-	*resp = c.Nodes
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	*resp = c.nodes()
 	return nil
 }
 
 func (c *Coordinator) Join(req *common.Node, resp *common.JoinAck) error {
-	c.Nodes[req.Address] = *req
-	c.Ring = c.Ring.AddNode(req.Address)
-	log.Printf("joined node [%s] to sdfs", req.Address)
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	// the newcomer takes over its share of the ring before the join returns
+	if err := c.changeMembership(LogEntry{Type: JoinEntry, Node: *req}); err != nil {
+		return err
+	}
+	log.Printf("joined node [%s] to sdfs", req.Addr())
 	return nil
 }
 
 func (c *Coordinator) GetVersions(req *common.GetVersionsRequest, resp *common.GetVersionsResponse) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
 	log.Printf("getting last [%d] versions of [%s]", req.NumVersions, req.Filename)
-	fg, ok := c.Files[req.Filename]
+	*resp = common.GetVersionsResponse{
+		Versions: []int{},
+		Manifests: []common.Manifest{},
+		Chunks: [][]string{},
+	}
+	fg, ok := c.Lookup(req.Filename)
 	if !ok {
 		log.Printf("file [%s] does not exist in SDFS", req.Filename)
 		return nil
 	}
-	*resp = common.GetVersionsResponse{
-		Versions: []string{},
-	}
-	for version := 1 ; version <= fg.Version ; version += 1 {
-		name := fmt.Sprintf("%d,%s", version, fg.Name)
-		log.Printf("aggregating [%s]", name)
-		resp.Versions = append(resp.Versions, name)
+	for version := fg.Version ; version >= 1 && len(resp.Versions) < req.NumVersions ; version -= 1 {
+		manifest, ok := fg.Manifests[version]
+		if !ok {
+			continue
+		}
+		resp.Versions = append(resp.Versions, version)
+		resp.Manifests = append(resp.Manifests, manifest)
 	}
+	resp.Chunks = fg.ChunkReplicas()
 	return nil
 }
 
 func (c *Coordinator) Delete(req *common.DeleteRequest, resp *common.DeleteResponse) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
 	log.Printf("deleting [%s]", req.Filename)
-	_, ok := c.Files[req.Filename]
+	unlock := c.lockFile(req.Filename)
+	defer unlock()
+	fg, ok := c.Lookup(req.Filename)
 	if !ok {
 		log.Printf("[%s] does not exist in SDFS", req.Filename)
 		*resp = false;
 		return nil
 	}
-	delete(c.Files, req.Filename)
+	participants := []participant{}
+	for i, chunk := range fg.Chunks {
+		update := common.FileUpdate{
+			Name: common.ChunkName(req.Filename, i),
+			Version: fg.Version,
+			OpType: common.DeleteFileOp,
+		}
+		for replica := range chunk.Replicas {
+			participants = append(participants, participant{replica, update})
+		}
+	}
+	if err := c.twoPhaseCommit(req.Filename, fg.Version, participants); err != nil {
+		*resp = false
+		return err
+	}
+	if err := c.commit(LogEntry{Type: DeleteEntry, File: fg}); err != nil {
+		*resp = false
+		return err
+	}
 	*resp = true 
 	return nil
 }
 
 func (c *Coordinator) Leave(req *common.Node, resp *common.LeaveAck) error {
-	// remove node from node map
-	delete(c.Nodes, req.Address)
-	// remove node from hashring
-	removed := c.Ring.RemoveNode(req.Address)
-	
-	// calculate and log the differences between the old ring and new ring
-	// send ReplicationReceived and ReplicationSent requests
-	c.Files = c.diff(removed)
-
-	c.Ring = removed
-	log.Printf("removed node [%s] from sdfs", req.Address)
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	if err := c.changeMembership(LogEntry{Type: LeaveEntry, Node: *req}); err != nil {
+		return err
+	}
+	log.Printf("removed node [%s] from sdfs", req.Addr())
 	return nil
 }
 
@@ -312,81 +881,277 @@ func (c *Coordinator) Leave(req *common.Node, resp *common.LeaveAck) error {
 	log.Printf("successfully received [%s] for [%s]", name, peer)
 } */
 
-func (c *Coordinator) Put(req *common.PutRequest, resp *common.PutAck) error {
-	log.Printf("received put request for file [%s]", req.Name)
-	// go c.receiveFile(req.Source, req.Name)
-	opType := common.UpdateFileOp
+// the file group of a file, new files start at version 0 without any chunks
+func (c *Coordinator) fileGroup(name string) common.FileGroup {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	fileGroup, ok := c.Files[name]
+	if ok {
+		return fileGroup.Clone()
+	}
+	log.Printf("files [%s] not found in sdfs", name)
+	return common.FileGroup{
+		Name: name,
+		Version: 0,
+		Replicas: common.AddressSet{},
+		Chunks: []common.Chunk{},
+		Manifests: map[int]common.Manifest{},
+	}
+}
 
-	// increment sequence number for the file
-	_, ok := c.Files[req.Name]
-	if !ok {
-		log.Printf("files [%s] not found in sdfs", req.Name)
-		log.Printf("ring has [%d] nodes", c.Ring.Size())
-		nodes, ok := c.Ring.GetNodes(req.Name, c.NumReplicas)
-		if !ok {
-			log.Panicln("could not get neighbors")
+// Put reserves the next version of a file for a new upload and tells the client where to stream each
+// of its chunks. Only one put of a file is in progress at a time, a second one is refused until the first
+// commits, is aborted or its client stops renewing it for UploadLease. Nothing becomes visible until the client
+// calls CommitPut.
+func (c *Coordinator) Put(req *common.PutRequest, resp *common.PutResponse) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	log.Printf("received put request for file [%s] (%d bytes)", req.Name, req.Size)
+	if strings.Contains(req.Name, common.ChunkSeparator) {
+		return common.Errorf(common.Invalid, "sdfs file names cannot contain [%s], got [%s]", common.ChunkSeparator, req.Name)
+	}
+	if req.Size < 0 {
+		return common.Errorf(common.Invalid, "invalid size [%d] for [%s]", req.Size, req.Name)
+	}
+
+	// the version is read after the previous put let go of the file, so it is already committed
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	if u, ok := c.uploads[req.Name]; ok && (u.committing || time.Since(u.renewed) < UploadLease) {
+		return common.Errorf(common.Conflict, "a put of [%s] version [%d] is in progress", req.Name, u.version)
+	}
+	n := c.numChunks(req.Size)
+	c.mu.RLock()
+	ring := c.Ring
+	c.mu.RUnlock()
+	fileGroup, err := c.placeChunks(c.fileGroup(req.Name), n, ring)
+	if err != nil {
+		return err
+	}
+	id := common.NewUploadID()
+	c.uploads[req.Name] = upload{id, fileGroup.Version + 1, time.Now(), false}
+	*resp = common.PutResponse{
+		Version: fileGroup.Version + 1,
+		UploadID: id,
+		ChunkSize: c.ChunkSize,
+		Chunks: fileGroup.ChunkReplicas()[:n],
+		WriteQuorum: c.WriteQuorum,
+	}
+	return nil
+}
+
+// RenewPut extends the reservation of a put whose client is still streaming blocks
+func (c *Coordinator) RenewPut(req *common.RenewPutRequest, resp *common.RenewPutAck) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	u, ok := c.uploads[req.Name]
+	if !ok || u.id != req.UploadID {
+		return common.Errorf(common.Conflict, "[%s] is not reserved for upload [%s] anymore", req.Name, req.UploadID)
+	}
+	u.renewed = time.Now()
+	c.uploads[req.Name] = u
+	return nil
+}
+
+// AbortPut gives up the reservation of a put its client failed, so the next put of the file does not wait
+// for the lease to run out. An upload that is committing already is left to its commit.
+func (c *Coordinator) AbortPut(req *common.AbortPutRequest, resp *common.AbortPutAck) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	if u, ok := c.uploads[req.Name]; ok && u.id == req.UploadID && !u.committing {
+		log.Printf("put of [%s] version [%d] aborted", req.Name, u.version)
+		delete(c.uploads, req.Name)
+	}
+	return nil
+}
+
+// whether the version of a file is reserved for the upload, a reserved upload is held from now on until
+// finishUpload even if its lease runs out
+func (c *Coordinator) reserved(name string, id string, version int) bool {
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	u, ok := c.uploads[name]
+	if !ok || u.id != id || u.version != version {
+		return false
+	}
+	u.committing = true
+	c.uploads[name] = u
+	return true
+}
+
+// frees a file for the next put unless another upload took it over already
+func (c *Coordinator) finishUpload(name string, id string) {
+	c.uploadsMu.Lock()
+	defer c.uploadsMu.Unlock()
+	if u, ok := c.uploads[name]; ok && u.id == id {
+		delete(c.uploads, name)
+	}
+}
+
+// CommitPut runs the two-phase commit for a version the client finished streaming to the participants
+// of every chunk and records the version's manifest
+func (c *Coordinator) CommitPut(req *common.CommitPutRequest, resp *common.PutAck) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	log.Printf("committing [%s] version [%d] in [%d] chunks", req.Name, req.Version, len(req.Chunks))
+
+	unlock := c.lockFile(req.Name)
+	defer unlock()
+	reserved := c.reserved(req.Name, req.UploadID, req.Version)
+	if reserved {
+		// whatever happens, the file is free for the next put afterwards
+		defer c.finishUpload(req.Name, req.UploadID)
+	}
+	current := c.fileGroup(req.Name)
+	if committed(current, req) {
+		// a commit sent again after its reply was lost, it went through the first time
+		log.Printf("[%s] version [%d] is committed already", req.Name, req.Version)
+		return nil
+	}
+	c.mu.RLock()
+	ring := c.Ring
+	c.mu.RUnlock()
+	fileGroup, err := c.placeChunks(current, len(req.Chunks), ring)
+	if err != nil {
+		// nothing was prepared yet, the staged chunks expire on their own
+		return err
+	}
+	manifest := common.Manifest{
+		Size: req.Size,
+		Chunks: []common.ChunkInfo{},
+	}
+	participants := []participant{}
+	var size int64
+	for i, chunk := range req.Chunks {
+		update := common.FileUpdate{
+			Name: common.ChunkName(req.Name, i),
+			Version: req.Version,
+			UploadID: req.UploadID,
+			OpType: common.UpdateFileOp,
+			Size: chunk.Size,
+			Checksum: chunk.Checksum,
+		}
+		if fileGroup.ChunkVersion(i) == 0 {
+			update.OpType = common.NewFileOp
 		}
-		addrSet := common.AddressSet{}
-		for _, n := range nodes {
-			addrSet[n] = struct{}{}
+		for _, p := range chunk.Participants {
+			if _, ok := fileGroup.Chunks[i].Replicas[p]; !ok {
+				err = common.Errorf(common.Conflict, "[%s] is not a replica of [%s]", p, update.Name)
+			}
+			participants = append(participants, participant{p, update})
 		}
-		c.Files[req.Name] = common.FileGroup{
-			Name: req.Name,
-			Version: 0,
-			Replicas: addrSet,
+		if len(chunk.Participants) < c.WriteQuorum {
+			err = common.Errorf(common.QuorumNotMet, "put of [%s] reached [%d] replicas, write quorum is [%d]", update.Name, len(chunk.Participants), c.WriteQuorum)
 		}
-		opType = common.NewFileOp
+		size += chunk.Size
+		manifest.Chunks = append(manifest.Chunks, common.ChunkInfo{
+			Size: chunk.Size,
+			Checksum: chunk.Checksum,
+		})
+	}
+	if err == nil && (len(req.Chunks) != c.numChunks(req.Size) || size != req.Size) {
+		err = common.Errorf(common.Invalid, "[%s] version [%d] has [%d] chunks of [%d] bytes, expected [%d] chunks of [%d] bytes", req.Name, req.Version, len(req.Chunks), size, c.numChunks(req.Size), req.Size)
+	}
+	if req.Version != fileGroup.Version + 1 {
+		err = common.Errorf(common.Conflict, "[%s] is at version [%d], cannot commit version [%d]", req.Name, fileGroup.Version, req.Version)
+	} else if !reserved {
+		err = common.Errorf(common.Conflict, "[%s] version [%d] is not reserved for upload [%s], it was given up or the leader changed", req.Name, req.Version, req.UploadID)
+	}
+	if err != nil {
+		c.rollback(participants)
+		return err
 	}
 
-	fileGroup := c.Files[req.Name]
-	fileGroup.Version += 1
-	c.Files[req.Name] = fileGroup
+	if err := c.twoPhaseCommit(req.Name, req.Version, participants); err != nil {
+		return err
+	}
+	fileGroup.Version = req.Version
+	fileGroup.Manifests[req.Version] = manifest
+	if err := c.commit(LogEntry{Type: PutEntry, File: fileGroup}); err != nil {
+		return err
+	}
+	go c.handOff(fileGroup, req)
+	return nil
+}
 
-	for replica := range c.Files[req.Name].Replicas {
-		if replica != c.Self.Address {
-			c.sendFileUpdate(replica, common.FileUpdate{
-				Name: req.Name,
-				Version: c.Files[req.Name].Version,
-				OpType: opType,
-			})
+// whether req is the put that committed the current version of the file
+func committed(fileGroup common.FileGroup, req *common.CommitPutRequest) bool {
+	manifest, ok := fileGroup.Manifests[req.Version]
+	if !ok || fileGroup.Version != req.Version || manifest.Size != req.Size || len(manifest.Chunks) != len(req.Chunks) {
+		return false
+	}
+	for i, chunk := range req.Chunks {
+		if manifest.Chunks[i].Size != chunk.Size || manifest.Chunks[i].Checksum != chunk.Checksum {
+			return false
 		}
 	}
+	return true
+}
 
-	return nil
+// Start runs the election, the failure detector, the repairs and the gossip membership until Stop is called
+func (c *Coordinator) Start() {
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+	if c.stop != nil {
+		return
+	}
+	c.stop = make(chan struct{})
+
+	if len(c.election.peers) == 0 {
+		// a lone candidate has nobody to hold an election with
+		c.election.mu.Lock()
+		c.election.role = Leader
+		term := c.election.Term
+		c.election.mu.Unlock()
+		c.lead(term)
+	}
+	go c.runElection(c.stop)
+	go c.runFailureDetector(c.stop)
+	go c.runRepairs(c.stop)
+	go c.runRetries(c.stop)
+	c.Membership.Start(c.election.peers)
+}
+
+func (c *Coordinator) Stop() {
+	c.stopMu.Lock()
+	defer c.stopMu.Unlock()
+	if c.stop != nil {
+		close(c.stop)
+		c.stop = nil
+	}
+	c.Membership.Stop()
 }
 
+// Serve starts the coordinator and answers rpcs on l until it is closed. Every coordinator gets
+// its own rpc server, so several of them can run in one process.
+func (c *Coordinator) Serve(l net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.Register(c); err != nil {
+		return err
+	}
+	if err := server.Register(c.Membership); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.Handle("/metrics", c.Counters)
+	c.Start()
+	return http.Serve(l, mux)
+}
 
 func (c *Coordinator) Run() {
-	
-	wg := sync.WaitGroup{}
-	
-	go func() {
-		log.Printf("starting failure detector server on [%s]", c.Self.Address)
-		ticker := time.NewTicker(c.pingPeriod)
-		quit := make(chan struct{})
-		for {
-		select {
-			case <- ticker.C:
-				failed := c.ping()
-				if len(failed) > 0 {
-					c.handleFailure(failed[0])
-				}
-			case <- quit:
-				ticker.Stop()
-				return
-			}
-		}
-	}()
-	
-	wg.Add(1)
-	go func() {
-		log.Printf("starting coordinator server on [%s]", c.Self.Address)
-		rpc.Register(c)
-		rpc.HandleHTTP()
-		l, e := net.Listen("tcp", fmt.Sprintf(":%d", DefaultPort))
-		if e != nil {
-			log.Fatal("listen error:", e)
-		}
-		defer http.Serve(l, nil)
-	}()
-}
\ No newline at end of file
+	log.Printf("starting coordinator server on [%s]", c.Self.Addr())
+	l, e := net.Listen("tcp", fmt.Sprintf(":%d", c.Self.Port))
+	if e != nil {
+		log.Fatal("listen error:", e)
+	}
+	log.Fatal(c.Serve(l))
+}
@@ -0,0 +1,389 @@
+package coordinator_test
+
+import (
+	"bytes"
+	"fmt"
+	"math/rand"
+	"net/rpc"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/client"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/coordinator"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/faults"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/testcluster"
+)
+
+// clients working on files of their own never see each other's writes, clients putting the same
+// file see their put commit or lose to another one with a conflict
+func TestConcurrentPutGetDelete(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.Candidates = 3
+	c := testcluster.Start(t, options)
+
+	wg := sync.WaitGroup{}
+	errs := make(chan error, 100)
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cl := c.Client(c.Replicas[i % len(c.Replicas)])
+			target := fmt.Sprintf("file-%d", i)
+			for round := 0; round < 4; round++ {
+				content := fmt.Sprintf("%d-%d", i, round)
+				if err := testcluster.Put(t, cl, target, content); err != nil {
+					errs <- fmt.Errorf("put of [%s]: %w", target, err)
+					return
+				}
+				got, err := testcluster.Get(t, cl, target, -1)
+				if err != nil || got != content {
+					errs <- fmt.Errorf("get of [%s] returned [%s], %v, want [%s]", target, got, err, content)
+					return
+				}
+				if round % 2 == 0 {
+					continue
+				}
+				if err := cl.Delete(target); err != nil {
+					errs <- fmt.Errorf("delete of [%s]: %w", target, err)
+					return
+				}
+				if _, err := testcluster.Get(t, cl, target, -1); common.CodeOf(err) != common.NotFound {
+					errs <- fmt.Errorf("get of deleted [%s] returned %v", target, err)
+					return
+				}
+			}
+		}(i)
+	}
+
+	written := sync.Map{}
+	for i := 0; i < 6; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cl := c.Client(c.Replicas[i % len(c.Replicas)])
+			content := fmt.Sprintf("shared-%d", i)
+			err := testcluster.Put(t, cl, "shared", content)
+			if err == nil {
+				written.Store(content, true)
+			} else if common.CodeOf(err) != common.Conflict {
+				errs <- fmt.Errorf("put of [shared]: %w", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Error(err)
+	}
+
+	got, err := testcluster.Get(t, c.Client(c.Replicas[0]), "shared", -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := written.Load(got); !ok {
+		t.Fatalf("[shared] holds [%s], which no successful put wrote", got)
+	}
+}
+
+// replicas leaving and joining while clients put and get leave every file readable once the ring settles
+func TestMembershipChangesDuringPuts(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.Replicas = 5
+	c := testcluster.Start(t, options)
+	churner := c.Replicas[4]
+
+	stop := make(chan struct{})
+	churned := make(chan error, 1)
+	go func() {
+		cl := c.Client(churner)
+		for i := 0; i < 3; i++ {
+			if err := cl.Leave(); err != nil {
+				churned <- err
+				return
+			}
+			if err := cl.Join(); err != nil {
+				churned <- err
+				return
+			}
+		}
+		close(stop)
+		churned <- nil
+	}()
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			cl := c.Client(c.Replicas[i])
+			for round := 0; ; round++ {
+				select {
+				case <- stop:
+					return
+				default:
+				}
+				target := fmt.Sprintf("file-%d", i)
+				// a put may race a rebalance and fail, what matters is the state afterwards
+				if err := testcluster.Put(t, cl, target, fmt.Sprintf("%d-%d", i, round)); err != nil {
+					t.Logf("put of [%s] during churn: %v", target, err)
+				}
+				if _, err := testcluster.Get(t, cl, target, -1); err != nil && common.CodeOf(err) != common.NotFound {
+					t.Logf("get of [%s] during churn: %v", target, err)
+				}
+			}
+		}(i)
+	}
+	if err := <- churned; err != nil {
+		close(stop)
+		wg.Wait()
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	ring, err := c.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring) != len(c.Replicas) {
+		t.Fatalf("ring has [%d] nodes after the churn, want [%d]", len(ring), len(c.Replicas))
+	}
+	for i := 0; i < 4; i++ {
+		cl := c.Client(c.Replicas[i])
+		target := fmt.Sprintf("file-%d", i)
+		if err := testcluster.Put(t, cl, target, "final"); err != nil {
+			t.Fatalf("put of [%s] after the churn: %v", target, err)
+		}
+		if got, err := testcluster.Get(t, cl, target, -1); err != nil || got != "final" {
+			t.Fatalf("get of [%s] after the churn returned [%s], %v", target, got, err)
+		}
+	}
+}
+
+// a commit the leader could not deliver is queued in the replicated log, so the next leader delivers it
+func TestRetriesSurviveFailover(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.Candidates = 3
+	options.RetryBackoff = 200 * time.Millisecond
+	c := testcluster.Start(t, options)
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+	if err := testcluster.Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	missing := c.Holder(t, "a", writer)
+
+	leader, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Network.Add(faults.Rule{
+		From: leader.Self.Addr(),
+		To: missing.Self.Addr(),
+		Method: "Replica.Commit",
+		Drop: 1,
+	})
+	if err := testcluster.Put(t, cl, "a", "second"); err != nil {
+		t.Fatal(err)
+	}
+	leader.Kill()
+
+	err = c.WaitFor(func() bool {
+		versions, err := missing.Replica.Store.Versions("a#0")
+		return err == nil && len(versions) > 0 && versions[len(versions) - 1] == 2
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the new leader did not retry the commit to [%s]: %v", missing.Name, err)
+	}
+}
+
+// a prepare the replicas refuse because the data does not match the commit fails with the replicas' code
+func TestPrepareFailureCode(t *testing.T) {
+	c := testcluster.Start(t, testcluster.DefaultOptions())
+	data := []byte("content")
+	putReq := common.PutRequest{
+		Name: "a",
+		Source: c.Replicas[0].Self.Addr(),
+		Size: int64(len(data)),
+	}
+	reserved := new(common.PutResponse)
+	if err := c.Coordinators.Call("Coordinator.Put", &putReq, reserved, coordinator.RequestTimeout); err != nil {
+		t.Fatal(err)
+	}
+	commit := common.CommitPutRequest{
+		Name: "a",
+		Version: reserved.Version,
+		UploadID: reserved.UploadID,
+		Size: int64(len(data)),
+		Chunks: []common.ChunkCommit{{
+			Size: int64(len(data)),
+			Checksum: "not the checksum of the data",
+		}},
+	}
+	for _, replica := range reserved.Chunks[0] {
+		block := common.WriteBlockRequest{
+			Name: common.ChunkName("a", 0),
+			Version: reserved.Version,
+			UploadID: reserved.UploadID,
+			Data: data,
+		}
+		if err := c.Network.Transport("").Call(replica, "Replica.WriteBlock", &block, new(common.WriteBlockAck), coordinator.RequestTimeout); err != nil {
+			t.Fatal(err)
+		}
+		commit.Chunks[0].Participants = append(commit.Chunks[0].Participants, replica)
+	}
+
+	err := c.Coordinators.Call("Coordinator.CommitPut", &commit, new(common.PutAck), coordinator.CommitTimeout)
+	if common.CodeOf(err) != common.Invalid {
+		t.Fatalf("commit with a wrong checksum returned %v, want invalid", err)
+	}
+	if code := client.ExitCode(err); code != 2 {
+		t.Fatalf("commit with a wrong checksum exits with [%d], want [2]", code)
+	}
+}
+
+// a replica's answer keeps its code when the coordinator relays the failed call to a client
+func TestRelayedCallErrorCode(t *testing.T) {
+	exitCodes := map[string]int{
+		common.Invalid: 2,
+		common.NotFound: 3,
+		common.Conflict: 6,
+	}
+	for code, want := range exitCodes {
+		answer := rpc.ServerError(common.Errorf(code, "[a#0] refused").Error())
+		failed := &coordinator.CallError{Method: "Replica.Prepare", Addr: "127.0.0.1:1", Err: answer}
+		relayed := rpc.ServerError(failed.Error())
+		if got := client.ExitCode(relayed); got != want {
+			t.Errorf("[%s] relayed as [%s] exits with [%d], want [%d]", code, relayed, got, want)
+		}
+	}
+}
+
+// a put its client gave up on does not hold the file until the reservation runs out
+func TestAbortedPutFreesFile(t *testing.T) {
+	c := testcluster.Start(t, testcluster.DefaultOptions())
+	cl := c.Client(c.Replicas[0])
+	putReq := common.PutRequest{
+		Name: "a",
+		Source: c.Replicas[0].Self.Addr(),
+		Size: 1,
+	}
+	reserved := new(common.PutResponse)
+	if err := c.Coordinators.Call("Coordinator.Put", &putReq, reserved, coordinator.RequestTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := testcluster.Put(t, cl, "a", "content"); common.CodeOf(err) != common.Conflict {
+		t.Fatalf("put of a reserved file returned %v, want conflict", err)
+	}
+	renew := common.RenewPutRequest{
+		Name: "a",
+		UploadID: reserved.UploadID,
+	}
+	if err := c.Coordinators.Call("Coordinator.RenewPut", &renew, new(common.RenewPutAck), coordinator.RequestTimeout); err != nil {
+		t.Fatal(err)
+	}
+
+	abort := common.AbortPutRequest{
+		Name: "a",
+		UploadID: reserved.UploadID,
+	}
+	if err := c.Coordinators.Call("Coordinator.AbortPut", &abort, new(common.AbortPutAck), coordinator.RequestTimeout); err != nil {
+		t.Fatal(err)
+	}
+	if err := testcluster.Put(t, cl, "a", "content"); err != nil {
+		t.Fatalf("put after the abort: %v", err)
+	}
+	if err := c.Coordinators.Call("Coordinator.RenewPut", &renew, new(common.RenewPutAck), coordinator.RequestTimeout); common.CodeOf(err) != common.Conflict {
+		t.Fatalf("renewing an aborted put returned %v, want conflict", err)
+	}
+}
+
+// a put of several full-size chunks commits, the replicas do not hash every chunk again while the
+// coordinator waits for them to prepare it
+func TestPutFullSizeChunks(t *testing.T) {
+	if testing.Short() {
+		t.Skip("puts hundreds of megabytes")
+	}
+	data := make([]byte, 4 * common.DefaultChunkSize)
+	rand.New(rand.NewSource(1)).Read(data)
+	local := filepath.Join(t.TempDir(), "big")
+	if err := os.WriteFile(local, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	// moving the data keeps the nodes busy, the default failure detection does not take that for failures
+	options := testcluster.DefaultOptions()
+	options.Membership = membership.DefaultConfig()
+	options.EvictionGrace = 10 * time.Second
+	c := testcluster.Start(t, options)
+	cl := c.Client(c.Replicas[0])
+	if err := cl.Put(local, "big", -1); err != nil {
+		t.Fatalf("put of [%d] chunks: %v", 4, err)
+	}
+
+	got := filepath.Join(t.TempDir(), "got")
+	if err := cl.Get("big", got, -1); err != nil {
+		t.Fatal(err)
+	}
+	read, err := os.ReadFile(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read, data) {
+		t.Fatalf("[big] read back [%d] bytes that differ from the [%d] put", len(read), len(data))
+	}
+}
+
+// a replica that never heard a delete committed gets it rolled back once the file is put again, and
+// takes part in puts again instead of refusing them as deletes of the file
+func TestStaleDeleteRolledBack(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.RetryBackoff = 200 * time.Millisecond
+	c := testcluster.Start(t, options)
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+	// the versions put after the delete start over below the deleted one
+	for _, content := range []string{"first", "second"} {
+		if err := testcluster.Put(t, cl, "a", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	missing := c.Holder(t, "a", writer)
+
+	leader, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the delete is prepared everywhere but never committed on the missing replica, which then gets no block of the next put
+	c.Network.Add(faults.Rule{
+		From: leader.Self.Addr(),
+		To: missing.Self.Addr(),
+		Method: "Replica.Commit",
+		Cut: true,
+	})
+	c.Network.Add(faults.Rule{
+		From: writer.Self.Addr(),
+		To: missing.Self.Addr(),
+		Method: "Replica.WriteBlock",
+		Cut: true,
+	})
+	if err := cl.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testcluster.Put(t, cl, "a", "third"); err != nil {
+		t.Fatal(err)
+	}
+	c.Network.Heal()
+
+	err = c.WaitFor(func() bool {
+		return testcluster.Put(t, cl, "a", "fourth") == nil
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("puts including [%s] kept failing: %v", missing.Name, err)
+	}
+	testcluster.Expect(t, cl, "a", 1, "third")
+	testcluster.Expect(t, cl, "a", -1, "fourth")
+}
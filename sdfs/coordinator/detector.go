@@ -0,0 +1,131 @@
+package coordinator
+
+import (
+	"log"
+	"sync"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
+)
+
+const (
+	DefaultSuspectProbes = 3
+	DefaultEvictionGrace = 10 * time.Second
+)
+
+// suspect is a node of the ring the gossip stopped considering alive. It keeps its files and
+// its place on the ring until the leader's own probes confirm the failure.
+type suspect struct {
+	since time.Time
+	// direct probes missed in a row
+	misses int
+	// whether the last direct probe was answered
+	reachable bool
+}
+
+// asks a replica directly whether it is up, the ping also tells it who leads
+func (c *Coordinator) probe(node common.Node) error {
+	ping := common.FDPing{
+		Leader: c.election.self,
+	}
+	return c.Transport.Call(node.Addr(), "Replica.FDAck", &ping, new(common.FDAck), c.RequestTimeout)
+}
+
+// probes every suspect once and returns the nodes whose failure is confirmed: gossip declared them
+// dead, they missed SuspectProbes probes in a row and have been suspected for EvictionGrace.
+// A suspect that answers or that the gossip finds alive again is reinstated, nothing is moved for it.
+func (c *Coordinator) confirmFailures(suspects map[string]*suspect) []common.Node {
+	nodes := c.nodes()
+	states := map[string]int{}
+	for addr, node := range nodes {
+		state := membership.Alive
+		if member, ok := c.Membership.Lookup(node.Addr()); ok {
+			state = member.State
+		}
+		states[addr] = state
+		s, suspected := suspects[addr]
+		if state == membership.Alive {
+			if suspected {
+				log.Printf("[%s] is alive again after [%d] missed probes, reinstating", addr, s.misses)
+				delete(suspects, addr)
+			}
+			continue
+		}
+		if !suspected {
+			log.Printf("suspecting [%s]", addr)
+			suspects[addr] = &suspect{since: time.Now()}
+		}
+	}
+	for addr := range suspects {
+		if _, ok := nodes[addr]; !ok {
+			// left or already evicted
+			delete(suspects, addr)
+		}
+	}
+
+	wg := sync.WaitGroup{}
+	answered := make(chan string, len(suspects))
+	for addr := range suspects {
+		wg.Add(1)
+		go func(node common.Node) {
+			defer wg.Done()
+			if err := c.probe(node); err == nil {
+				answered <- node.Addr()
+			}
+		}(nodes[addr])
+	}
+	wg.Wait()
+	close(answered)
+	reachable := map[string]struct{}{}
+	for addr := range answered {
+		reachable[addr] = struct{}{}
+	}
+
+	output := []common.Node{}
+	for addr, s := range suspects {
+		if _, ok := reachable[addr]; ok {
+			// keep it on the ring and restart the grace period, the gossip catches up once it refutes
+			if !s.reachable {
+				log.Printf("[%s] answered a probe after [%d] misses, reinstating", addr, s.misses)
+			}
+			s.reachable = true
+			s.misses = 0
+			s.since = time.Now()
+			continue
+		}
+		s.reachable = false
+		s.misses += 1
+		if states[addr] == membership.Dead && s.misses >= c.SuspectProbes && time.Since(s.since) >= c.EvictionGrace {
+			output = append(output, nodes[addr])
+		}
+	}
+	return output
+}
+
+// watches the gossip membership and evicts the nodes whose failure the leader confirmed
+func (c *Coordinator) runFailureDetector(stop chan struct{}) {
+	log.Printf("starting failure detector on [%s]", c.Self.Addr())
+	ticker := time.NewTicker(c.Membership.Config.ProtocolPeriod)
+	defer ticker.Stop()
+	suspects := map[string]*suspect{}
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		// every candidate gossips, only the leader evicts nodes
+		if !c.IsLeader() {
+			suspects = map[string]*suspect{}
+			continue
+		}
+		failed := c.confirmFailures(suspects)
+		if len(failed) > 0 {
+			c.handleFailures(failed)
+			for _, node := range failed {
+				delete(suspects, node.Addr())
+			}
+		}
+	}
+}
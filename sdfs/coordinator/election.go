@@ -0,0 +1,500 @@
+package coordinator
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+const (
+	Follower = 0
+	Candidate = 1
+	Leader = 2
+)
+
+const (
+	HeartbeatPeriod = 500 * time.Millisecond
+	// followers start an election after hearing nothing from a leader for ElectionTimeout plus up to
+	// the same amount of random jitter, leaders step down after not reaching a majority for as long
+	ElectionTimeout = 2 * time.Second
+	electionFile = "election.json"
+)
+
+type VoteRequest struct {
+	Term int
+	Candidate string
+	LastIndex int
+	LastTerm int
+}
+
+type VoteResponse struct {
+	Term int
+	Granted bool
+}
+
+type AppendRequest struct {
+	Term int
+	Leader string
+	// index and term of the entry preceding Entries, the follower must end its log with it
+	PrevIndex int
+	PrevTerm int
+	Entries []LogEntry
+	// entries up to this index reached a majority, the follower applies them
+	Commit int
+}
+
+type AppendResponse struct {
+	Term int
+	Success bool
+}
+
+type InstallSnapshotRequest struct {
+	Term int
+	Leader string
+	Snapshot Snapshot
+}
+
+// election is the state a coordinator candidate keeps to agree on a leader with the others.
+// Term and vote are persisted so a restarted candidate never votes twice in the same term.
+type election struct {
+	mu sync.Mutex
+	// coordinator addresses of the other candidates
+	peers []string
+	self string
+	role int
+	// the leader committed an entry of its own term, so everything logged before is applied and it serves requests
+	ready bool
+	Term int
+	VotedFor string
+	leader string
+	lastContact time.Time
+	// last time a majority acked the leader's heartbeat
+	lastMajority time.Time
+	dir string
+}
+
+func (e *election) persist() error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(e.dir, electionFile), data)
+}
+
+func (e *election) load() error {
+	data, err := os.ReadFile(filepath.Join(e.dir, electionFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, e)
+}
+
+// must be called with e.mu held
+func (e *election) becomeFollower(term int, leader string) {
+	if term > e.Term {
+		e.Term = term
+		e.VotedFor = ""
+		if err := e.persist(); err != nil {
+			log.Printf("could not persist election state: %v", err)
+		}
+	}
+	if e.role == Leader {
+		log.Printf("stepping down as leader in term [%d]", e.Term)
+	}
+	e.role = Follower
+	e.ready = false
+	e.leader = leader
+}
+
+func (e *election) majority() int {
+	return (len(e.peers) + 1) / 2 + 1
+}
+
+// IsLeader reports whether this coordinator currently leads and serves requests
+func (c *Coordinator) IsLeader() bool {
+	c.election.mu.Lock()
+	defer c.election.mu.Unlock()
+	return c.election.role == Leader && c.election.ready
+}
+
+// returns an error pointing at the leader unless this coordinator is the leader
+func (c *Coordinator) checkLeader() error {
+	c.election.mu.Lock()
+	defer c.election.mu.Unlock()
+	if c.election.role != Leader || !c.election.ready {
+		return common.NotLeader(c.election.leader)
+	}
+	return nil
+}
+
+// Leader tells clients which coordinator currently leads, the answer is empty during an election
+func (c *Coordinator) Leader(req *common.LeaderRequest, resp *common.LeaderResponse) error {
+	c.election.mu.Lock()
+	defer c.election.mu.Unlock()
+	*resp = common.LeaderResponse{
+		Leader: c.election.leader,
+	}
+	return nil
+}
+
+func (c *Coordinator) RequestVote(req *VoteRequest, resp *VoteResponse) error {
+	// c.mu is never taken while holding e.mu
+	c.mu.RLock()
+	lastIndex, lastTerm := c.wal.Index, c.wal.Term
+	c.mu.RUnlock()
+
+	e := c.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if req.Term > e.Term {
+		e.becomeFollower(req.Term, "")
+	}
+	*resp = VoteResponse{
+		Term: e.Term,
+	}
+	if req.Term < e.Term || (e.VotedFor != "" && e.VotedFor != req.Candidate) {
+		return nil
+	}
+	// only vote for candidates whose log holds everything ours does
+	if req.LastTerm < lastTerm || (req.LastTerm == lastTerm && req.LastIndex < lastIndex) {
+		return nil
+	}
+	e.VotedFor = req.Candidate
+	if err := e.persist(); err != nil {
+		return err
+	}
+	e.lastContact = time.Now()
+	resp.Granted = true
+	log.Printf("voted for [%s] in term [%d]", req.Candidate, e.Term)
+	return nil
+}
+
+// accepts a leader's term and tells whether the request is stale
+func (c *Coordinator) acceptLeader(term int, leader string) (int, bool) {
+	e := c.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if term < e.Term {
+		return e.Term, false
+	}
+	if term > e.Term || e.role != Follower || e.leader != leader {
+		e.becomeFollower(term, leader)
+		log.Printf("following leader [%s] in term [%d]", leader, term)
+	}
+	e.lastContact = time.Now()
+	return e.Term, true
+}
+
+func (c *Coordinator) AppendEntries(req *AppendRequest, resp *AppendResponse) error {
+	term, ok := c.acceptLeader(req.Term, req.Leader)
+	*resp = AppendResponse{
+		Term: term,
+	}
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entries := req.Entries
+	if req.PrevIndex != c.wal.Index || req.PrevTerm != c.wal.Term {
+		// entries we logged before, e.g. when only our reply got lost, are not logged twice
+		if req.PrevIndex != c.applied || req.PrevTerm != c.appliedTerm || !logged(c.pending, entries) {
+			// a log that does not end where the leader expects gets replaced by a snapshot
+			return nil
+		}
+		entries = entries[len(c.pending):]
+	}
+	for _, entry := range entries {
+		if err := c.wal.Append(&entry); err != nil {
+			return err
+		}
+		c.pending = append(c.pending, entry)
+	}
+	c.applyUpTo(req.Commit)
+	resp.Success = true
+	return nil
+}
+
+// whether entries starts with every entry in pending, an index and term never name two different entries
+func logged(pending []LogEntry, entries []LogEntry) bool {
+	if len(pending) > len(entries) {
+		return false
+	}
+	for i, entry := range pending {
+		if entry.Index != entries[i].Index || entry.Term != entries[i].Term {
+			return false
+		}
+	}
+	return true
+}
+
+func (c *Coordinator) InstallSnapshot(req *InstallSnapshotRequest, resp *AppendResponse) error {
+	term, ok := c.acceptLeader(req.Term, req.Leader)
+	*resp = AppendResponse{
+		Term: term,
+	}
+	if !ok {
+		return nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := c.wal.Install(req.Snapshot); err != nil {
+		return err
+	}
+	c.restore(req.Snapshot)
+	c.pending = nil
+	log.Printf("installed snapshot from [%s] at index [%d]", req.Leader, req.Snapshot.Index)
+	resp.Success = true
+	return nil
+}
+
+// brings one follower up to date, the follower either takes the entries or the whole state and then
+// the entries. prevIndex is the last entry the leader applied, so it is the commit index too.
+// Must be called with c.appendMu held. Returns false if the follower could not be updated.
+func (c *Coordinator) syncFollower(peer string, term int, prevIndex int, prevTerm int, entries []LogEntry) bool {
+	req := AppendRequest{
+		Term: term,
+		Leader: c.election.self,
+		PrevIndex: prevIndex,
+		PrevTerm: prevTerm,
+		Entries: entries,
+		Commit: prevIndex,
+	}
+	resp := new(AppendResponse)
+	if err := c.Transport.Call(peer, "Coordinator.AppendEntries", &req, resp, RequestTimeout); err != nil {
+		return false
+	}
+	if resp.Term > term {
+		c.stepDown(resp.Term)
+		return false
+	}
+	if resp.Success {
+		return true
+	}
+	c.mu.RLock()
+	snap := InstallSnapshotRequest{
+		Term: term,
+		Leader: c.election.self,
+		Snapshot: c.snapshot(),
+	}
+	c.mu.RUnlock()
+	if snap.Snapshot.Index != prevIndex || snap.Snapshot.Term != prevTerm {
+		// what we applied moved, we are no longer the leader that sent the entries
+		return false
+	}
+	if err := c.Transport.Call(peer, "Coordinator.InstallSnapshot", &snap, resp, RequestTimeout); err != nil || !resp.Success {
+		return false
+	}
+	if len(entries) == 0 {
+		return true
+	}
+	// the snapshot ends where the entries start
+	if err := c.Transport.Call(peer, "Coordinator.AppendEntries", &req, resp, RequestTimeout); err != nil {
+		return false
+	}
+	return resp.Success
+}
+
+// sends entries following the one at prevIndex to every follower, or a heartbeat when there are none,
+// and reports whether a majority including the leader logged them. Must be called with c.appendMu held
+// so followers see entries in order, and without c.mu so metadata stays readable meanwhile.
+func (c *Coordinator) replicateLog(term int, prevIndex int, prevTerm int, entries []LogEntry) bool {
+	e := c.election
+	e.mu.Lock()
+	peers, majority := e.peers, e.majority()
+	e.mu.Unlock()
+	wg := sync.WaitGroup{}
+	acks := make(chan bool, len(peers))
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			acks <- c.syncFollower(peer, term, prevIndex, prevTerm, entries)
+		}(peer)
+	}
+	wg.Wait()
+	close(acks)
+	acked := 1
+	for ok := range acks {
+		if ok {
+			acked += 1
+		}
+	}
+	if acked >= majority {
+		e.mu.Lock()
+		e.lastMajority = time.Now()
+		e.mu.Unlock()
+		return true
+	}
+	return false
+}
+
+// sends a heartbeat that carries the entries not committed yet, if any. Once a majority logged them the
+// leader applies them and serves requests again.
+func (c *Coordinator) heartbeat() {
+	c.appendMu.Lock()
+	defer c.appendMu.Unlock()
+	c.election.mu.Lock()
+	role, term := c.election.role, c.election.Term
+	c.election.mu.Unlock()
+	if role != Leader {
+		return
+	}
+	c.mu.RLock()
+	prevIndex, prevTerm, entries := c.applied, c.appliedTerm, append([]LogEntry{}, c.pending...)
+	c.mu.RUnlock()
+	if !c.replicateLog(term, prevIndex, prevTerm, entries) || len(entries) == 0 {
+		return
+	}
+	// entries of earlier terms are committed by one of this term only
+	last := entries[len(entries) - 1]
+	if last.Term == term && c.applyReplicated(last) {
+		c.startServing(term)
+	}
+}
+
+// keeps the leader of term from serving requests until the entry at index reached a majority
+func (c *Coordinator) stopServing(term int, index int) {
+	e := c.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.role == Leader && e.Term == term && e.ready {
+		e.ready = false
+		e.leader = ""
+		log.Printf("not serving requests until entry [%d] reaches a majority", index)
+	}
+}
+
+// lets the leader of term serve requests, everything logged before is applied
+func (c *Coordinator) startServing(term int) {
+	e := c.election
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.role == Leader && e.Term == term && !e.ready {
+		e.ready = true
+		e.leader = e.self
+		log.Printf("leading in term [%d]", term)
+	}
+}
+
+func (c *Coordinator) stepDown(term int) {
+	c.election.mu.Lock()
+	defer c.election.mu.Unlock()
+	c.election.becomeFollower(term, "")
+}
+
+func (c *Coordinator) startElection() {
+	e := c.election
+	e.mu.Lock()
+	e.role = Candidate
+	e.Term += 1
+	e.VotedFor = e.self
+	e.leader = ""
+	e.lastContact = time.Now()
+	if err := e.persist(); err != nil {
+		log.Printf("could not persist election state: %v", err)
+	}
+	term, peers, majority := e.Term, e.peers, e.majority()
+	e.mu.Unlock()
+
+	c.mu.RLock()
+	req := VoteRequest{
+		Term: term,
+		Candidate: e.self,
+		LastIndex: c.wal.Index,
+		LastTerm: c.wal.Term,
+	}
+	c.mu.RUnlock()
+	log.Printf("starting election for term [%d]", term)
+
+	wg := sync.WaitGroup{}
+	votes := make(chan bool, len(peers))
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			resp := new(VoteResponse)
+			if err := c.Transport.Call(peer, "Coordinator.RequestVote", &req, resp, RequestTimeout); err != nil {
+				return
+			}
+			if resp.Term > term {
+				c.stepDown(resp.Term)
+			}
+			votes <- resp.Granted
+		}(peer)
+	}
+	wg.Wait()
+	close(votes)
+	granted := 1
+	for v := range votes {
+		if v {
+			granted += 1
+		}
+	}
+
+	e.mu.Lock()
+	won := granted >= majority && e.role == Candidate && e.Term == term
+	if won {
+		e.role = Leader
+		e.lastMajority = time.Now()
+		log.Printf("elected leader for term [%d] with [%d] votes", term, granted)
+	}
+	e.mu.Unlock()
+	if won {
+		c.lead(term)
+	}
+}
+
+// takes over as the leader of term. Entries logged in earlier terms are only known to be committed once an
+// entry of this term is, so the leader commits an empty one before it serves any request. That also makes
+// the other candidates stop their elections.
+func (c *Coordinator) lead(term int) {
+	if err := c.commit(LogEntry{Type: NoopEntry}); err != nil {
+		// the heartbeats go on sending it
+		log.Printf("could not take over as leader in term [%d]: %v", term, err)
+		return
+	}
+	c.startServing(term)
+}
+
+// runs elections while there is no leader and sends heartbeats while this coordinator leads
+func (c *Coordinator) runElection(stop chan struct{}) {
+	timeout := ElectionTimeout + time.Duration(rand.Int63n(int64(ElectionTimeout)))
+	ticker := time.NewTicker(HeartbeatPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		e := c.election
+		e.mu.Lock()
+		role, lastContact, lastMajority := e.role, e.lastContact, e.lastMajority
+		e.mu.Unlock()
+
+		switch role {
+		case Leader:
+			c.heartbeat()
+			if time.Since(lastMajority) > ElectionTimeout {
+				// we are probably cut off from the other candidates, let them elect someone else
+				c.stepDown(0)
+			}
+		default:
+			if time.Since(lastContact) > timeout {
+				c.startElection()
+				timeout = ElectionTimeout + time.Duration(rand.Int63n(int64(ElectionTimeout)))
+			}
+		}
+	}
+}
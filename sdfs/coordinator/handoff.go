@@ -0,0 +1,48 @@
+package coordinator
+
+import (
+	"log"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+// leaves a hint for every replica of a chunk that did not take part in a put on one of the replicas
+// that did, so the version reaches the missing replica once it answers again
+func (c *Coordinator) handOff(fg common.FileGroup, req *common.CommitPutRequest) {
+	for i, chunk := range req.Chunks {
+		if i >= len(fg.Chunks) || len(chunk.Participants) == 0 {
+			continue
+		}
+		took := map[string]struct{}{}
+		for _, p := range chunk.Participants {
+			took[p] = struct{}{}
+		}
+		for target := range fg.Chunks[i].Replicas {
+			if _, ok := took[target]; ok {
+				continue
+			}
+			hint := common.Hint{
+				Target: target,
+				Name: common.ChunkName(req.Name, i),
+				Version: req.Version,
+				Checksum: chunk.Checksum,
+			}
+			c.storeHint(hint, chunk.Participants, i)
+		}
+	}
+}
+
+// hands a hint to the first holder that takes it starting at holders[first], so hints of
+// different chunks are spread over the holders
+func (c *Coordinator) storeHint(hint common.Hint, holders []string, first int) {
+	for k := range holders {
+		holder := holders[(first + k) % len(holders)]
+		err := c.Transport.Call(holder, "Replica.StoreHint", &hint, new(common.HintAck), RequestTimeout)
+		if err == nil {
+			log.Printf("[%s] missed [%s] version [%d], [%s] holds the hint", hint.Target, hint.Name, hint.Version, holder)
+			return
+		}
+		log.Printf("could not leave hint for [%s] on [%s]: %v", hint.Target, holder, err)
+	}
+	log.Printf("[%s] missed [%s] version [%d] and no replica took the hint", hint.Target, hint.Name, hint.Version)
+}
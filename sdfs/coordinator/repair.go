@@ -0,0 +1,150 @@
+package coordinator
+
+import (
+	"fmt"
+	"log"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+)
+
+const (
+	// corrupt copies waiting for repair, reports beyond it are dropped until the next scrub finds them again
+	RepairQueueSize = 1024
+)
+
+// ReportCorruption is called by whoever found a copy of a chunk that does not match its checksum
+// or is missing. The copy is taken out of the chunk's replica set and replaced by a good one in the background.
+func (c *Coordinator) ReportCorruption(req *common.CorruptionReport, resp *common.CorruptionAck) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	if _, _, ok := common.ParseChunkName(req.Name); !ok {
+		return common.Errorf(common.Invalid, "[%s] is not a chunk name", req.Name)
+	}
+	if req.Missing {
+		log.Printf("[%s] version [%d] is missing on [%s]", req.Name, req.Version, req.Replica)
+	} else {
+		log.Printf("[%s] version [%d] on [%s] is corrupt", req.Name, req.Version, req.Replica)
+	}
+	c.scheduleRepair(*req)
+	return nil
+}
+
+// queues a repair unless the same copy is already waiting for one
+func (c *Coordinator) scheduleRepair(report common.CorruptionReport) {
+	key := report.Name + "@" + report.Replica
+	c.repairsMu.Lock()
+	defer c.repairsMu.Unlock()
+	if _, ok := c.pendingRepairs[key]; ok {
+		return
+	}
+	select {
+	case c.repairs <- report:
+		c.pendingRepairs[key] = struct{}{}
+	default:
+		log.Printf("repair queue is full, dropping repair of [%s] on [%s]", report.Name, report.Replica)
+	}
+}
+
+// repairs the queued copies one at a time
+func (c *Coordinator) runRepairs(stop chan struct{}) {
+	for {
+		var report common.CorruptionReport
+		select {
+		case <- stop:
+			return
+		case report = <- c.repairs:
+		}
+		if c.IsLeader() {
+			if err := c.repairChunk(report); err != nil {
+				log.Printf("could not repair [%s] on [%s]: %v", report.Name, report.Replica, err)
+			}
+		}
+		c.repairsMu.Lock()
+		delete(c.pendingRepairs, report.Name + "@" + report.Replica)
+		c.repairsMu.Unlock()
+	}
+}
+
+// drops a corrupt copy from the replica set and rebalances the file, which copies the chunk back
+// from a replica whose copy is intact. The bad copy is overwritten if the ring still places the chunk there.
+func (c *Coordinator) repairChunk(report common.CorruptionReport) error {
+	file, index, _ := common.ParseChunkName(report.Name)
+	unlock := c.lockFile(file)
+	fg, ok := c.Lookup(file)
+	if !ok || index >= len(fg.Chunks) {
+		unlock()
+		return nil
+	}
+	fg = fg.Clone()
+	replicas := fg.Chunks[index].Replicas
+	if _, ok := replicas[report.Replica]; !ok {
+		// repaired already or moved away
+		unlock()
+		return nil
+	}
+	if len(replicas) == 1 {
+		unlock()
+		return fmt.Errorf("[%s] has no other replica", report.Name)
+	}
+	delete(replicas, report.Replica)
+	fg.Replicas = chunkReplicas(fg.Chunks)
+	err := c.commit(LogEntry{Type: ReplicationEntry, File: fg})
+	unlock()
+	if err != nil {
+		return err
+	}
+	c.Counters.Add(metrics.ChunkRepairs, 1)
+	if err := c.rebalanceFile(file); err != nil {
+		c.retryRebalance(file, err)
+		return err
+	}
+	if fg, ok := c.Lookup(file); ok && index < len(fg.Chunks) {
+		if _, ok := fg.Chunks[index].Replicas[report.Replica]; !ok {
+			c.dropReplica(report.Replica, report.Name)
+		}
+	}
+	return nil
+}
+
+func (c *Coordinator) Metrics(req *common.MetricsRequest, resp *common.MetricsResponse) error {
+	*resp = c.Counters.Snapshot()
+	return nil
+}
+
+// Assigned lists every chunk a replica should hold with its versions and replicas, so the replica's
+// scrubber can tell missing versions from garbage and its anti-entropy knows whom to compare with
+func (c *Coordinator) Assigned(req *common.AssignedRequest, resp *common.AssignedResponse) error {
+	if err := c.checkLeader(); err != nil {
+		return err
+	}
+	*resp = common.AssignedResponse{
+		Chunks: []common.AssignedChunk{},
+	}
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	for name, fg := range c.Files {
+		for i, chunk := range fg.Chunks {
+			if _, ok := chunk.Replicas[req.Address]; !ok {
+				continue
+			}
+			replicas := []string{}
+			for r := range chunk.Replicas {
+				replicas = append(replicas, r)
+			}
+			checksums := map[int]string{}
+			for version, manifest := range fg.Manifests {
+				if i < len(manifest.Chunks) {
+					checksums[version] = manifest.Chunks[i].Checksum
+				}
+			}
+			resp.Chunks = append(resp.Chunks, common.AssignedChunk{
+				Name: common.ChunkName(name, i),
+				Checksums: checksums,
+				Replicas: replicas,
+			})
+		}
+	}
+	return nil
+}
@@ -0,0 +1,293 @@
+package coordinator
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/rpc"
+	"sort"
+	"strings"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+)
+
+const (
+	// tries of a request to a replica before the work is left to the retry queue
+	CallAttempts = 3
+	CallBackoff = 100 * time.Millisecond
+	// first delay of a queued retry, it doubles with every failed attempt up to RetryMaxDelay
+	DefaultRetryBackoff = time.Second
+	RetryMaxDelay = 5 * time.Minute
+	// queued work is given up after this many failed attempts
+	MaxRetryAttempts = 12
+)
+
+const (
+	// moves a file onto the replicas the ring assigns it
+	RebalanceTask = 1
+	// resends a file update to one replica
+	UpdateTask = 2
+)
+
+// ErrNoNodes is returned when there is no node on the ring to place a chunk on
+var ErrNoNodes = errors.New("no nodes to place replicas on")
+
+// CallError is a request to a replica that failed
+type CallError struct {
+	Method string
+	Addr string
+	Err error
+}
+
+func (e *CallError) Error() string {
+	msg := e.Err.Error()
+	// timeouts name the call already
+	if strings.Contains(msg, e.Addr) && strings.Contains(msg, e.Method) {
+		return msg
+	}
+	// the code stays in front, only the message reaches whoever this error is relayed to over rpc
+	code := common.CodeOf(e.Err)
+	if code == common.Internal {
+		return fmt.Sprintf("[%s] on [%s] failed: %s", e.Method, e.Addr, msg)
+	}
+	return fmt.Sprintf("[%s] [%s] on [%s] failed: %s", code, e.Method, e.Addr, strings.TrimPrefix(msg, "[" + code + "] "))
+}
+
+func (e *CallError) Unwrap() error {
+	return e.Err
+}
+
+// Temporary reports whether the replica may answer a retry. A replica that answered with an error
+// will answer the same way again, a timeout or a refused connection may go away.
+func (e *CallError) Temporary() bool {
+	_, answered := e.Err.(rpc.ServerError)
+	return !answered
+}
+
+// calls a replica, retrying with backoff as long as it does not answer
+func (c *Coordinator) call(addr string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	var err *CallError
+	delay := CallBackoff
+	for attempt := 0; attempt < CallAttempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(delay)
+			delay *= 2
+		}
+		cerr := c.Transport.Call(addr, method, args, reply, timeout)
+		if cerr == nil {
+			return nil
+		}
+		err = &CallError{method, addr, cerr}
+		if !err.Temporary() {
+			break
+		}
+	}
+	return err
+}
+
+// RetryTask is work that failed and is tried again later: a rebalance of File,
+// or Update sent to Addr through Method
+type RetryTask struct {
+	Type int
+	File string
+	Addr string
+	Method string
+	Update common.FileUpdate
+	Attempts int
+	Due time.Time
+	// why the last attempt failed
+	LastError string
+}
+
+func (t RetryTask) key() string {
+	if t.Type == RebalanceTask {
+		return "rebalance " + t.File
+	}
+	return t.Method + " " + t.Update.Name + "@" + t.Addr
+}
+
+func (t RetryTask) String() string {
+	if t.Type == RebalanceTask {
+		return fmt.Sprintf("rebalance of [%s]", t.File)
+	}
+	return fmt.Sprintf("[%s] of [%s] version [%d] on [%s]", t.Method, t.Update.Name, t.Update.Version, t.Addr)
+}
+
+// queues a task unless the same work is queued already
+func (c *Coordinator) queueRetry(t RetryTask) (bool, error) {
+	c.retriesMu.Lock()
+	defer c.retriesMu.Unlock()
+	c.mu.RLock()
+	_, queued := c.Retries[t.key()]
+	c.mu.RUnlock()
+	if queued {
+		return false, nil
+	}
+	if err := c.commit(LogEntry{Type: RetryEntry, Retry: t}); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// records an attempt at a queued task, or removes it when done is set
+func (c *Coordinator) updateRetry(t RetryTask, done bool) {
+	c.retriesMu.Lock()
+	defer c.retriesMu.Unlock()
+	entry := LogEntry{Type: RetryEntry, Retry: t}
+	if done {
+		entry.Type = RetryDoneEntry
+	}
+	if err := c.commit(entry); err != nil {
+		log.Printf("could not record the attempt at %s: %v", t, err)
+	}
+}
+
+// the queued tasks due at now, oldest first
+func (c *Coordinator) dueRetries(now time.Time) []RetryTask {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	due := []RetryTask{}
+	for _, t := range c.Retries {
+		if !t.Due.After(now) {
+			due = append(due, t)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].Due.Before(due[j].Due)
+	})
+	return due
+}
+
+// delay before the next attempt of a task that failed attempts times
+func (c *Coordinator) retryDelay(attempts int) time.Duration {
+	delay := c.RetryBackoff
+	for i := 1; i < attempts && delay < RetryMaxDelay; i++ {
+		delay *= 2
+	}
+	if delay > RetryMaxDelay {
+		delay = RetryMaxDelay
+	}
+	return delay
+}
+
+// queues work that failed to be tried again after the backoff
+func (c *Coordinator) retryLater(t RetryTask, err error) {
+	t.Attempts = 1
+	t.Due = time.Now().Add(c.retryDelay(t.Attempts))
+	t.LastError = err.Error()
+	queued, qerr := c.queueRetry(t)
+	if qerr != nil {
+		log.Printf("could not queue %s for retry: %v", t, qerr)
+		return
+	}
+	if queued {
+		c.Counters.Add(metrics.RetriesQueued, 1)
+		log.Printf("queued %s for retry: %v", t, err)
+	}
+}
+
+// queues a rebalance of a file that did not reach every replica the ring assigns it
+func (c *Coordinator) retryRebalance(file string, err error) {
+	c.retryLater(RetryTask{Type: RebalanceTask, File: file}, err)
+}
+
+// queues an update that did not reach a replica
+func (c *Coordinator) retryUpdate(addr string, method string, update common.FileUpdate, err error) {
+	c.retryLater(RetryTask{Type: UpdateTask, Addr: addr, Method: method, Update: update}, err)
+}
+
+// whether a queued update still has to be sent, with the file lock held. Resending a delete
+// must not remove data put since, nor a rollback throw away a version committed since.
+func (c *Coordinator) updateNeeded(t RetryTask) bool {
+	if _, ok := c.nodes()[t.Addr]; !ok {
+		// left the ring, whatever it holds is moved or dropped when it joins again
+		return false
+	}
+	file, index, _ := common.ParseChunkName(t.Update.Name)
+	fg, exists := c.Lookup(file)
+	holds := false
+	version := 0
+	if exists && index < len(fg.Chunks) {
+		_, holds = fg.Chunks[index].Replicas[t.Addr]
+		version = fg.ChunkVersion(index)
+	}
+	switch {
+	case t.Method == "Replica.Commit" && t.Update.OpType == common.DeleteFileOp:
+		// a delete of a file put again since is rolled back instead
+		return !exists
+	case t.Method == "Replica.Commit":
+		_, committed := fg.Manifests[t.Update.Version]
+		return holds && committed
+	case t.Method == "Replica.Rollback" && t.Update.OpType == common.DeleteFileOp:
+		return exists
+	case t.Method == "Replica.Rollback":
+		return version < t.Update.Version
+	case t.Update.OpType == common.DeleteFileOp:
+		// a copy dropped after the chunk moved away, unless it moved back
+		return !holds
+	}
+	return true
+}
+
+// makes one attempt at a queued task
+func (c *Coordinator) attempt(t RetryTask) error {
+	if t.Type == RebalanceTask {
+		return c.rebalanceFile(t.File)
+	}
+	file, _, _ := common.ParseChunkName(t.Update.Name)
+	unlock := c.lockFile(file)
+	defer unlock()
+	if _, exists := c.Lookup(file); exists && t.Method == "Replica.Commit" && t.Update.OpType == common.DeleteFileOp {
+		// the file was put again since, the replica must not delete it but still has to let go of the delete
+		log.Printf("%s is stale, rolling the delete back instead", t)
+		t.Method = "Replica.Rollback"
+	}
+	if !c.updateNeeded(t) {
+		log.Printf("%s is no longer needed", t)
+		return nil
+	}
+	return c.call(t.Addr, t.Method, &t.Update, new(struct{}), common.FlushTimeout(RequestTimeout, t.Update.Size))
+}
+
+// retries the queued work that is due, only the leader does. A task that fails is put back with
+// twice the delay, a task that keeps failing is given up after MaxRetryAttempts.
+func (c *Coordinator) runRetries(stop chan struct{}) {
+	ticker := time.NewTicker(c.RetryBackoff)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		if !c.IsLeader() {
+			continue
+		}
+		for _, t := range c.dueRetries(time.Now()) {
+			select {
+			case <- stop:
+				return
+			default:
+			}
+			err := c.attempt(t)
+			if err == nil {
+				log.Printf("retried %s after [%d] attempts", t, t.Attempts)
+				c.updateRetry(t, true)
+				continue
+			}
+			t.Attempts += 1
+			t.LastError = err.Error()
+			if t.Attempts > MaxRetryAttempts {
+				log.Printf("giving up on %s after [%d] attempts: %v", t, MaxRetryAttempts, err)
+				c.Counters.Add(metrics.RetriesAbandoned, 1)
+				c.updateRetry(t, true)
+				continue
+			}
+			t.Due = time.Now().Add(c.retryDelay(t.Attempts))
+			log.Printf("%s failed again, next attempt in %s: %v", t, c.retryDelay(t.Attempts), err)
+			c.updateRetry(t, false)
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package coordinator
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+const (
+	PutEntry = 1
+	DeleteEntry = 2
+	JoinEntry = 3
+	LeaveEntry = 4
+	FailureEntry = 5
+	ReplicationEntry = 6
+	// queues a retry or records a failed attempt of one
+	RetryEntry = 7
+	// removes a retry that succeeded or was given up
+	RetryDoneEntry = 8
+	// changes nothing, a new leader commits it to commit what earlier leaders logged
+	NoopEntry = 9
+)
+
+const (
+	DefaultSnapshotInterval = 1000
+	walFile = "wal.log"
+	snapshotFile = "snapshot.json"
+)
+
+// LogEntry is one change to the coordinator's metadata. Put, delete and replication
+// entries carry the resulting file group, join and leave entries the node, failure
+// entries every node that failed in the same detection round and retry entries the task.
+type LogEntry struct {
+	Index int
+	// election term of the leader that logged the entry
+	Term int
+	Type int
+	File common.FileGroup
+	Node common.Node
+	Nodes []common.Node
+	Retry RetryTask
+}
+
+// Snapshot is the metadata after applying every entry up to Index
+type Snapshot struct {
+	Index int
+	Term int
+	Files map[string]common.FileGroup
+	Nodes map[string]common.Node
+	Retries map[string]RetryTask
+}
+
+// WAL appends metadata changes to <dir>/wal.log, one json entry per line, and compacts
+// them into <dir>/snapshot.json every SnapshotInterval entries
+type WAL struct {
+	dir string
+	f *os.File
+	// index and term of the last appended entry
+	Index int
+	Term int
+	SnapshotInterval int
+	sinceSnapshot int
+}
+
+// OpenWAL loads the latest snapshot and every entry logged after it.
+// A torn entry at the end of the log, left by a crash mid-append, is cut off.
+func OpenWAL(dir string, snapshotInterval int) (*WAL, Snapshot, []LogEntry, error) {
+	snap := Snapshot{
+		Files: map[string]common.FileGroup{},
+		Nodes: map[string]common.Node{},
+		Retries: map[string]RetryTask{},
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, snap, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, snapshotFile))
+	if err == nil {
+		if err := json.Unmarshal(data, &snap); err != nil {
+			return nil, snap, nil, fmt.Errorf("corrupt snapshot in [%s]: %w", dir, err)
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, snap, nil, err
+	}
+
+	f, err := os.OpenFile(filepath.Join(dir, walFile), os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, snap, nil, err
+	}
+	entries := []LogEntry{}
+	var good int64
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				log.Printf("dropping torn entry at the end of the write-ahead log")
+			}
+			break
+		}
+		if err != nil {
+			f.Close()
+			return nil, snap, nil, err
+		}
+		var entry LogEntry
+		if err := json.Unmarshal(line, &entry); err != nil {
+			log.Printf("dropping unreadable write-ahead log entry: %v", err)
+			break
+		}
+		good += int64(len(line))
+		// entries already in the snapshot are left over from a crash during compaction
+		if entry.Index > snap.Index {
+			entries = append(entries, entry)
+		}
+	}
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, snap, nil, err
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, snap, nil, err
+	}
+
+	w := &WAL{
+		dir: dir,
+		f: f,
+		Index: snap.Index,
+		Term: snap.Term,
+		SnapshotInterval: snapshotInterval,
+		sinceSnapshot: len(entries),
+	}
+	if len(entries) > 0 {
+		w.Index = entries[len(entries)-1].Index
+		w.Term = entries[len(entries)-1].Term
+	}
+	return w, snap, entries, nil
+}
+
+// Append durably writes the entry, assigning it the next index unless it already carries one
+func (w *WAL) Append(entry *LogEntry) error {
+	if entry.Index == 0 {
+		entry.Index = w.Index + 1
+	}
+	if entry.Index != w.Index + 1 {
+		return fmt.Errorf("cannot append entry [%d] after entry [%d]", entry.Index, w.Index)
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if _, err := w.f.Write(append(data, '\n')); err != nil {
+		return err
+	}
+	if err := w.f.Sync(); err != nil {
+		return err
+	}
+	w.Index = entry.Index
+	w.Term = entry.Term
+	w.sinceSnapshot += 1
+	return nil
+}
+
+// ShouldSnapshot reports whether enough entries piled up since the last snapshot
+func (w *WAL) ShouldSnapshot() bool {
+	return w.SnapshotInterval > 0 && w.sinceSnapshot >= w.SnapshotInterval
+}
+
+// Snapshot persists the state reached at the last appended entry and empties the log
+func (w *WAL) Snapshot(files map[string]common.FileGroup, nodes map[string]common.Node, retries map[string]RetryTask) error {
+	return w.Install(Snapshot{
+		Index: w.Index,
+		Term: w.Term,
+		Files: files,
+		Nodes: nodes,
+		Retries: retries,
+	})
+}
+
+// Install replaces everything logged so far with the snapshot
+func (w *WAL) Install(snap Snapshot) error {
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(w.dir, snapshotFile)
+	if err := writeFileSync(path, data); err != nil {
+		return err
+	}
+
+	// every entry is covered by the snapshot now
+	if err := w.f.Truncate(0); err != nil {
+		return err
+	}
+	if _, err := w.f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	w.Index = snap.Index
+	w.Term = snap.Term
+	w.sinceSnapshot = 0
+	log.Printf("compacted metadata log into snapshot at index [%d]", w.Index)
+	return nil
+}
+
+// replaces path with data through a temporary file so a crash leaves either the old or the new content
+func writeFileSync(path string, data []byte) error {
+	tmp, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(path + ".tmp", path); err != nil {
+		return err
+	}
+	dir, err := os.Open(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func (w *WAL) Close() error {
+	return w.f.Close()
+}
@@ -0,0 +1,187 @@
+// Package faults wraps a transport with rules that drop, delay, duplicate or partition the
+// rpcs between named nodes, so tests can reproduce lossy links, slow links and split brains.
+package faults
+
+import (
+	"errors"
+	"math/rand"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+// Rule applies to every call from From to To whose method starts with Method, empty fields match anything.
+// Nodes are named by the address of their rpc server.
+type Rule struct {
+	From string
+	To string
+	Method string
+	// the link is down, calls fail at once like a node that cannot be dialed and are never delivered
+	Cut bool
+	// probability the request is lost, the caller times out
+	Drop float64
+	// probability the reply is lost after the callee handled the request, the caller times out
+	DropReply float64
+	// probability the request is delivered a second time
+	Duplicate float64
+	// time the request spends on the link, plus up to Jitter more
+	Delay time.Duration
+	Jitter time.Duration
+}
+
+func (r Rule) matches(from string, to string, method string) bool {
+	return (r.From == "" || r.From == from) && (r.To == "" || r.To == to) && strings.HasPrefix(method, r.Method)
+}
+
+// Network is the link between every node of a test cluster
+type Network struct {
+	next common.Transport
+	rules map[int]Rule
+	nextRule int
+	// partition group of each node, nodes in different groups cannot reach each other
+	groups map[string]int
+	rand *rand.Rand
+	mu sync.Mutex
+}
+
+// NewNetwork sends calls through next once the rules let them pass, seed makes the random faults repeatable
+func NewNetwork(next common.Transport, seed int64) *Network {
+	return &Network{
+		next: next,
+		rules: map[int]Rule{},
+		groups: map[string]int{},
+		rand: rand.New(rand.NewSource(seed)),
+	}
+}
+
+// Transport is what the node at from calls the others through
+func (n *Network) Transport(from string) common.Transport {
+	return &transport{
+		network: n,
+		from: from,
+	}
+}
+
+// Add installs a rule and returns its id for Remove
+func (n *Network) Add(rule Rule) int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.nextRule += 1
+	n.rules[n.nextRule] = rule
+	return n.nextRule
+}
+
+func (n *Network) Remove(id int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	delete(n.rules, id)
+}
+
+// Block cuts the link from one node to another, replies to calls going the other way still flow
+func (n *Network) Block(from string, to string) int {
+	return n.Add(Rule{
+		From: from,
+		To: to,
+		Cut: true,
+	})
+}
+
+// Partition splits the nodes into groups that cannot reach each other, nodes not in any group reach everyone
+func (n *Network) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.groups = map[string]int{}
+	for i, group := range groups {
+		for _, node := range group {
+			n.groups[node] = i
+		}
+	}
+}
+
+// Heal removes every rule and partition
+func (n *Network) Heal() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.rules = map[int]Rule{}
+	n.groups = map[string]int{}
+}
+
+// what happens to one call
+type fate struct {
+	cut bool
+	drop bool
+	dropReply bool
+	duplicate bool
+	delay time.Duration
+}
+
+func (n *Network) decide(from string, to string, method string) fate {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	f := fate{}
+	fromGroup, fromGrouped := n.groups[from]
+	toGroup, toGrouped := n.groups[to]
+	if fromGrouped && toGrouped && fromGroup != toGroup {
+		f.cut = true
+	}
+	for _, r := range n.rules {
+		if !r.matches(from, to, method) {
+			continue
+		}
+		f.cut = f.cut || r.Cut
+		f.drop = f.drop || n.rand.Float64() < r.Drop
+		f.dropReply = f.dropReply || n.rand.Float64() < r.DropReply
+		f.duplicate = f.duplicate || n.rand.Float64() < r.Duplicate
+		f.delay += r.Delay
+		if r.Jitter > 0 {
+			f.delay += time.Duration(n.rand.Int63n(int64(r.Jitter)))
+		}
+	}
+	return f
+}
+
+type transport struct {
+	network *Network
+	from string
+}
+
+func (t *transport) Call(addr string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	f := t.network.decide(t.from, addr, method)
+	next := t.network.next
+	if f.cut {
+		return &common.UnreachableError{Addr: addr, Err: errors.New("the link is cut")}
+	}
+	if f.drop {
+		time.Sleep(timeout)
+		return common.TimeoutError(method, addr, timeout)
+	}
+	if f.duplicate {
+		// the copy's reply goes nowhere
+		go func() {
+			time.Sleep(f.delay)
+			next.Call(addr, method, args, reflect.New(reflect.TypeOf(reply).Elem()).Interface(), timeout)
+		}()
+	}
+	if f.delay >= timeout {
+		// the request still arrives, only too late for the caller
+		go func() {
+			time.Sleep(f.delay)
+			next.Call(addr, method, args, reflect.New(reflect.TypeOf(reply).Elem()).Interface(), timeout)
+		}()
+		time.Sleep(timeout)
+		return common.TimeoutError(method, addr, timeout)
+	}
+	time.Sleep(f.delay)
+	start := time.Now()
+	err := next.Call(addr, method, args, reply, timeout - f.delay)
+	if f.dropReply {
+		if remaining := timeout - f.delay - time.Since(start); remaining > 0 {
+			time.Sleep(remaining)
+		}
+		return common.TimeoutError(method, addr, timeout)
+	}
+	return err
+}
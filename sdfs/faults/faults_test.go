@@ -0,0 +1,331 @@
+package faults_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/faults"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/testcluster"
+)
+
+// a leader cut off from the other candidates cannot commit, the majority elects a new leader that
+// serves clients, and the old leader follows it once the partition heals
+func TestPartitionedLeader(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.Candidates = 3
+	c := testcluster.Start(t, options)
+	cl := c.Client(c.Replicas[0])
+	if err := testcluster.Put(t, cl, "a", "before"); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	majority := []string{}
+	for _, n := range append(c.Candidates, c.Replicas...) {
+		if n != old {
+			majority = append(majority, n.Self.Addr())
+		}
+	}
+	c.Network.Partition([]string{old.Self.Addr()}, majority)
+
+	err = c.WaitFor(func() bool {
+		for _, n := range c.Candidates {
+			if n != old && n.Coordinator.IsLeader() {
+				return true
+			}
+		}
+		return false
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the majority did not elect a leader: %v", err)
+	}
+	if err := testcluster.Put(t, cl, "a", "during"); err != nil {
+		t.Fatalf("put on the majority side: %v", err)
+	}
+	err = c.WaitFor(func() bool {
+		return !old.Coordinator.IsLeader()
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the cut off leader did not step down: %v", err)
+	}
+
+	c.Network.Heal()
+	testcluster.Expect(t, cl, "a", -1, "during")
+	// the old leader has to take part in commits again, it has the put made while it was cut off
+	for _, n := range c.Candidates {
+		if n != old && !n.Coordinator.IsLeader() {
+			n.Kill()
+		}
+	}
+	err = c.WaitFor(func() bool {
+		return testcluster.Put(t, cl, "a", "after") == nil
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the old leader did not rejoin: %v", err)
+	}
+	testcluster.Expect(t, cl, "a", 2, "during")
+	testcluster.Expect(t, cl, "a", -1, "after")
+}
+
+// a put whose commit reply is lost times out for the client but is committed once, not twice
+func TestDroppedCommitReply(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.Candidates = 3
+	c := testcluster.Start(t, options)
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+
+	id := c.Network.Add(faults.Rule{
+		From: writer.Self.Addr(),
+		Method: "Coordinator.CommitPut",
+		DropReply: 1,
+	})
+	if err := testcluster.Put(t, cl, "a", "first"); common.CodeOf(err) != common.Timeout {
+		t.Fatalf("put with a lost commit reply returned %v, want timeout", err)
+	}
+	c.Network.Remove(id)
+
+	testcluster.Expect(t, cl, "a", -1, "first")
+	if err := testcluster.Put(t, cl, "a", "second"); err != nil {
+		t.Fatal(err)
+	}
+	testcluster.Expect(t, cl, "a", 1, "first")
+	testcluster.Expect(t, cl, "a", 2, "second")
+}
+
+// a replica whose blocks are lost or slow does not keep a put from reaching the write quorum
+func TestDroppedAndDelayedBlocks(t *testing.T) {
+	c := testcluster.Start(t, testcluster.DefaultOptions())
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+	if err := testcluster.Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	replicas, err := c.FileReplicas("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c.Network.Add(faults.Rule{
+		From: writer.Self.Addr(),
+		To: replicas[0],
+		Method: "Replica.WriteBlock",
+		Drop: 1,
+	})
+	c.Network.Add(faults.Rule{
+		From: writer.Self.Addr(),
+		Method: "Replica.",
+		Delay: 20 * time.Millisecond,
+		Jitter: 20 * time.Millisecond,
+	})
+	if err := testcluster.Put(t, cl, "a", "second"); err != nil {
+		t.Fatalf("put with one replica losing blocks: %v", err)
+	}
+	c.Network.Heal()
+	testcluster.Expect(t, cl, "a", -1, "second")
+}
+
+// a metadata change that reached one follower without a majority keeps its place in the log, the next
+// change does not reuse it, so a follower that missed that one cannot hold the failed change in its place
+func TestFailedEntryIsNotReused(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.Candidates = 3
+	c := testcluster.Start(t, options)
+	cl := c.Client(c.Replicas[0])
+	if err := testcluster.Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	leader, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	followers := []*testcluster.Node{}
+	for _, n := range c.Candidates {
+		if n != leader {
+			followers = append(followers, n)
+		}
+	}
+
+	// the first follower logs the put without the leader hearing back, the second never gets it
+	c.Network.Add(faults.Rule{
+		From: leader.Self.Addr(),
+		To: followers[0].Self.Addr(),
+		Method: "Coordinator.AppendEntries",
+		DropReply: 1,
+	})
+	c.Network.Add(faults.Rule{
+		From: leader.Self.Addr(),
+		To: followers[1].Self.Addr(),
+		Method: "Coordinator.",
+		Cut: true,
+	})
+	if err := testcluster.Put(t, cl, "a", "failed"); err == nil {
+		t.Fatalf("put reached a majority of coordinators through one follower")
+	}
+	// the first follower misses the next change
+	c.Network.Heal()
+	c.Network.Add(faults.Rule{
+		From: leader.Self.Addr(),
+		To: followers[0].Self.Addr(),
+		Method: "Coordinator.",
+		Cut: true,
+	})
+	err = c.WaitFor(func() bool {
+		return testcluster.Put(t, cl, "b", "content") == nil
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("put after the failed one: %v", err)
+	}
+
+	c.Network.Heal()
+	err = c.WaitFor(func() bool {
+		want, _ := leader.Coordinator.Lookup("a")
+		for _, n := range c.Candidates {
+			a, _ := n.Coordinator.Lookup("a")
+			if _, ok := n.Coordinator.Lookup("b"); !ok || a.Version != want.Version {
+				return false
+			}
+		}
+		return true
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the candidates did not agree on the metadata: %v", err)
+	}
+}
+
+// a transport that answers every call itself and records the calls that reached it
+type recorder struct {
+	mu sync.Mutex
+	calls []string
+}
+
+func (r *recorder) Call(addr string, method string, args interface{}, reply interface{}, timeout time.Duration) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, addr + " " + method)
+	return nil
+}
+
+func (r *recorder) delivered() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string{}, r.calls...)
+}
+
+// calls over a cut link fail at once as unreachable and are never delivered, other links keep working
+func TestCutLink(t *testing.T) {
+	next := &recorder{}
+	n := faults.NewNetwork(next, 1)
+	n.Block("a", "b")
+	n.Partition([]string{"a", "b"}, []string{"c"})
+
+	start := time.Now()
+	for _, to := range []string{"b", "c"} {
+		err := n.Transport("a").Call(to, "Replica.Prepare", nil, new(common.P1Ack), time.Second)
+		var unreachable *common.UnreachableError
+		if !errors.As(err, &unreachable) || common.CodeOf(err) != common.Unavailable {
+			t.Fatalf("call from [a] to [%s] returned %v, want unreachable", to, err)
+		}
+	}
+	if time.Since(start) >= time.Second {
+		t.Fatalf("calls over cut links waited for their timeout")
+	}
+	if err := n.Transport("b").Call("a", "Replica.Prepare", nil, new(common.P1Ack), time.Second); err != nil {
+		t.Fatalf("call in the direction that is not cut: %v", err)
+	}
+	if got := next.delivered(); len(got) != 1 || got[0] != "a Replica.Prepare" {
+		t.Fatalf("delivered %v, want only the call from [b] to [a]", got)
+	}
+
+	n.Heal()
+	if err := n.Transport("a").Call("c", "Replica.Prepare", nil, new(common.P1Ack), time.Second); err != nil {
+		t.Fatalf("call after the network healed: %v", err)
+	}
+}
+
+// prepares and commits the replicas get twice still leave every replica with each version once, and
+// deletes going through twice do not keep the file from being put again
+func TestDuplicatedPrepareAndCommit(t *testing.T) {
+	c := testcluster.Start(t, testcluster.DefaultOptions())
+	cl := c.Client(c.Replicas[0])
+	for _, method := range []string{"Replica.Prepare", "Replica.Commit"} {
+		c.Network.Add(faults.Rule{
+			Method: method,
+			Duplicate: 1,
+		})
+	}
+
+	if err := testcluster.Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testcluster.Put(t, cl, "a", "second"); err != nil {
+		t.Fatal(err)
+	}
+	testcluster.Expect(t, cl, "a", 1, "first")
+	testcluster.Expect(t, cl, "a", -1, "second")
+	replicas, err := c.FileReplicas("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range c.Replicas {
+		for _, addr := range replicas {
+			if n.Self.Addr() != addr {
+				continue
+			}
+			versions, err := n.Replica.Store.Versions("a#0")
+			if err != nil || len(versions) != 2 || versions[0] != 1 || versions[1] != 2 {
+				t.Fatalf("[%s] stores versions %v, %v, want [1 2]", n.Name, versions, err)
+			}
+		}
+	}
+
+	if err := cl.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := testcluster.Get(t, cl, "a", -1); common.CodeOf(err) != common.NotFound {
+		t.Fatalf("get of deleted [a] returned %v, want not-found", err)
+	}
+	if err := testcluster.Put(t, cl, "a", "third"); err != nil {
+		t.Fatalf("put after the delete: %v", err)
+	}
+	testcluster.Expect(t, cl, "a", -1, "third")
+}
+
+// a replica that stops answering during a put misses it without failing it and catches up once it answers again
+func TestPausedReplica(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.HintReplayInterval = 200 * time.Millisecond
+	// the pause outlasts the suspicion timeout, it must not get the replica evicted and its chunks moved
+	options.EvictionGrace = 10 * time.Second
+	c := testcluster.Start(t, options)
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+	if err := testcluster.Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	paused := c.Holder(t, "a", writer)
+
+	paused.Pause()
+	if err := testcluster.Put(t, cl, "a", "second"); err != nil {
+		paused.Resume()
+		t.Fatalf("put with a paused replica: %v", err)
+	}
+	paused.Resume()
+	err := c.WaitFor(func() bool {
+		versions, err := paused.Replica.Store.Versions("a#0")
+		return err == nil && len(versions) > 0 && versions[len(versions) - 1] == 2
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("[%s] did not catch up: %v", paused.Name, err)
+	}
+	for _, n := range c.Replicas {
+		testcluster.Expect(t, c.Client(n), "a", 1, "first")
+		testcluster.Expect(t, c.Client(n), "a", -1, "second")
+	}
+}
@@ -2,98 +2,85 @@ package main
 
 import (
 	"flag"
+	"fmt"
 	"log"
+	"os"
 	"sync"
-	"time"
 
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/client"
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/config"
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/coordinator"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/replica"
 
 )
 
-const (
-	DefaultPort                     = 60221
-	DefaultFailureChannelBufferSize = 10
-)
-
 var (
-	MachineIdx    string
-	PingPeriod    time.Duration
-	PingTimeout   time.Duration
-	IsCoordinator bool
+	ConfigPath string
+	NodeName   string
 )
 
 func init() {
-	flag.BoolVar(&IsCoordinator, "coordinator", false, "true if running a coordinator instance, false otherwise")
-	flag.StringVar(&MachineIdx, "machine_idx", "01", "the server machine index")
-	flag.DurationVar(&PingPeriod, "ping_period", 3 * time.Second, "the ping period")
-	flag.DurationVar(&PingTimeout, "ping_timeout", 1500 * time.Millisecond, "the request timeout")
+	flag.StringVar(&ConfigPath, "config", config.DefaultPath, "the cluster file listing every node and the tuning parameters")
+	flag.StringVar(&NodeName, "node", "01", "the name of the node this process runs in the cluster file")
 	flag.Parse()
 }
 
 func main() {
-	nodes := map[string]common.Node{
-		"fa22-cs425-3301.cs.illinois.edu": {
-			Address: "fa22-cs425-3301.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3302.cs.illinois.edu": {
-			Address: "fa22-cs425-3302.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3303.cs.illinois.edu": {
-			Address: "fa22-cs425-3303.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3304.cs.illinois.edu": {
-			Address: "fa22-cs425-3304.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3305.cs.illinois.edu": {
-			Address: "fa22-cs425-3305.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3306.cs.illinois.edu": {
-			Address: "fa22-cs425-3306.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3307.cs.illinois.edu": {
-			Address: "fa22-cs425-3307.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3308.cs.illinois.edu": {
-			Address: "fa22-cs425-3308.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3309.cs.illinois.edu": {
-			Address: "fa22-cs425-3309.cs.illinois.edu",
-			Port: DefaultPort,
-		},
-		"fa22-cs425-3310.cs.illinois.edu": {
-			Address: "fa22-cs425-3310.cs.illinois.edu",
-			Port: DefaultPort,
-		},
+	cluster, err := config.Load(ConfigPath)
+	if err != nil {
+		log.Fatalf("could not load cluster: %v", err)
 	}
-	self, ok := nodes["fa22-cs425-33" + MachineIdx + ".cs.illinois.edu"]
+	node, ok := cluster.Node(NodeName)
 	if !ok {
-		log.Panicf("machine with idx [%s] does not exist", MachineIdx)
+		log.Fatalf("node [%s] does not exist in [%s]", NodeName, ConfigPath)
 	}
+	self := node.Node()
+
+	candidates := cluster.Candidates()
+	coordinators := common.NewCoordinators(candidates)
+
+	if flag.NArg() > 0 {
+		// run one command against the cluster as this node and exit with its status, without starting the node
+		cli := client.Client{
+			Self: self,
+			Coordinators: coordinators,
+		}
+		err := cli.Exec(flag.Args())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %v\n", flag.Arg(0), err)
+		}
+		os.Exit(client.ExitCode(err))
+	}
+
+	// every node gossips on the port of its rpc server
+	members := membership.New(self, cluster.Membership())
 
 	wg := sync.WaitGroup{}
 	wg.Add(1)
 	go func() {
-		if IsCoordinator {
-			log.Printf("starting coordinator on [%s]", self.Address)
-			c := coordinator.NewCoordinator(self, 4, map[string]common.Node{}, PingPeriod, PingTimeout)
+		if node.Coordinator {
+			log.Printf("starting coordinator on [%s]", self.Addr())
+			c := coordinator.NewCoordinator(self, cluster.NumReplicas, cluster.WriteQuorum, cluster.ReadQuorum, map[string]common.Node{}, candidates, members, cluster.PingTimeout.Duration)
+			c.SuspectProbes = cluster.SuspectProbes
+			c.EvictionGrace = cluster.EvictionGrace.Duration
+			c.ChunkSize = cluster.ChunkSize
+			c.RetryBackoff = cluster.RetryBackoff.Duration
+			if err := c.Recover(node.MetaDir, cluster.SnapshotInterval); err != nil {
+				log.Fatalf("could not recover metadata from [%s]: %v", node.MetaDir, err)
+			}
 			c.Run()
 		} else {
-			log.Printf("starting sdfs client on [%s]", self.Address)
-			r := replica.Replica{
-				Self: self,
-				Port: replica.DefaultPort,
+			log.Printf("starting sdfs client on [%s]", self.Addr())
+			r, err := replica.NewReplica(self, self.Port, node.DataDir, coordinators, members)
+			if err != nil {
+				log.Fatalf("could not open data directory [%s]: %v", node.DataDir, err)
 			}
+			r.ScrubInterval = cluster.ScrubInterval.Duration
+			r.ScrubRate = cluster.ScrubRate
+			r.AntiEntropyInterval = cluster.AntiEntropyInterval.Duration
+			r.HintReplayInterval = cluster.HintReplayInterval.Duration
 			r.Run()
 		}
 		wg.Done()
@@ -101,6 +88,7 @@ func main() {
 
 	cli := client.Client{
 		Self: self,
+		Coordinators: coordinators,
 	}
 	cli.Run()
 }
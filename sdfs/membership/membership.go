@@ -0,0 +1,456 @@
+package membership
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+const (
+	Alive = 0
+	Suspect = 1
+	Dead = 2
+)
+
+const (
+	DefaultProtocolPeriod = 1 * time.Second
+	DefaultPingTimeout = 300 * time.Millisecond
+	DefaultSuspicionTimeout = 5 * time.Second
+	DefaultIndirectProbes = 3
+	// every update is piggybacked on retransmitMult * log(n) messages
+	retransmitMult = 3
+)
+
+var stateNames = map[int]string{
+	Alive: "alive",
+	Suspect: "suspect",
+	Dead: "dead",
+}
+
+// Member is a node as seen by the gossip protocol. Node.IterationNumber is the member's
+// incarnation, only the member itself increases it, to refute suspicion or to rejoin.
+type Member struct {
+	Node common.Node
+	State int
+}
+
+func (m Member) Addr() string {
+	return m.Node.Addr()
+}
+
+func (m Member) String() string {
+	return fmt.Sprintf("[%s] %s (incarnation %d)", m.Addr(), stateNames[m.State], m.Node.IterationNumber)
+}
+
+type Config struct {
+	ProtocolPeriod time.Duration
+	PingTimeout time.Duration
+	SuspicionTimeout time.Duration
+	// number of members asked to probe a target that missed a direct ping
+	IndirectProbes int
+}
+
+func DefaultConfig() Config {
+	return Config{
+		ProtocolPeriod: DefaultProtocolPeriod,
+		PingTimeout: DefaultPingTimeout,
+		SuspicionTimeout: DefaultSuspicionTimeout,
+		IndirectProbes: DefaultIndirectProbes,
+	}
+}
+
+type PingRequest struct {
+	From Member
+	Updates []Member
+}
+
+type PingResponse struct {
+	Updates []Member
+}
+
+type PingReqRequest struct {
+	From Member
+	Target string
+	Updates []Member
+}
+
+type SyncRequest struct {
+	From Member
+}
+
+type SyncResponse struct {
+	Members []Member
+}
+
+type broadcast struct {
+	member Member
+	transmits int
+}
+
+// Membership runs a SWIM style failure detector: every protocol period it pings one member,
+// asks others to probe it indirectly if the ping is missed and gossips suspicion, death and
+// refutation by piggybacking them on its pings and acks.
+type Membership struct {
+	Config Config
+	Transport common.Transport
+	self Member
+	members map[string]Member
+	suspectedAt map[string]time.Time
+	broadcasts []*broadcast
+	// round-robin order of probe targets, reshuffled after every pass
+	probeOrder []string
+	// closed to stop the protocol loop
+	stop chan struct{}
+	mu sync.Mutex
+}
+
+// New creates the membership of a node, self's rpc server must have the Membership service registered
+func New(self common.Node, config Config) *Membership {
+	// a restarted node must outrank whatever the cluster remembers about its previous life
+	self.IterationNumber = int(time.Now().UnixNano())
+	me := Member{
+		Node: self,
+		State: Alive,
+	}
+	return &Membership{
+		Config: config,
+		Transport: common.DefaultTransport,
+		self: me,
+		members: map[string]Member{
+			me.Addr(): me,
+		},
+		suspectedAt: map[string]time.Time{},
+	}
+}
+
+// Lookup returns what this node believes about the member at addr
+func (m *Membership) Lookup(addr string) (Member, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	member, ok := m.members[addr]
+	return member, ok
+}
+
+// Members returns every known member, dead ones included
+func (m *Membership) Members() []Member {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	output := []Member{}
+	for _, member := range m.members {
+		output = append(output, member)
+	}
+	return output
+}
+
+// must be called with m.mu held
+func (m *Membership) queue(member Member) {
+	for i, b := range m.broadcasts {
+		if b.member.Addr() == member.Addr() {
+			m.broadcasts = append(m.broadcasts[:i], m.broadcasts[i+1:]...)
+			break
+		}
+	}
+	m.broadcasts = append(m.broadcasts, &broadcast{member: member})
+}
+
+// picks the updates to piggyback on the next message, must be called with m.mu held
+func (m *Membership) piggyback() []Member {
+	limit := retransmitMult * int(math.Ceil(math.Log2(float64(len(m.members) + 1))))
+	updates := []Member{}
+	kept := []*broadcast{}
+	for _, b := range m.broadcasts {
+		updates = append(updates, b.member)
+		b.transmits += 1
+		if b.transmits < limit {
+			kept = append(kept, b)
+		}
+	}
+	m.broadcasts = kept
+	return updates
+}
+
+// must be called with m.mu held
+func (m *Membership) setMember(member Member) {
+	old, known := m.members[member.Addr()]
+	m.members[member.Addr()] = member
+	if member.State == Suspect {
+		m.suspectedAt[member.Addr()] = time.Now()
+	} else {
+		delete(m.suspectedAt, member.Addr())
+	}
+	m.queue(member)
+	if !known || old.State != member.State {
+		log.Printf("member %s", member)
+	}
+}
+
+// applies a gossiped update following SWIM's precedence rules, must be called with m.mu held
+func (m *Membership) merge(update Member) {
+	addr := update.Addr()
+	inc := update.Node.IterationNumber
+	if addr == m.self.Addr() {
+		if update.State != Alive && inc >= m.self.Node.IterationNumber {
+			// somebody thinks we are suspect or dead, refute it with a newer incarnation
+			m.self.Node.IterationNumber = inc + 1
+			m.members[addr] = m.self
+			m.queue(m.self)
+			log.Printf("refuting %s with incarnation [%d]", update, m.self.Node.IterationNumber)
+		}
+		return
+	}
+	cur, known := m.members[addr]
+	curInc := cur.Node.IterationNumber
+	switch update.State {
+	case Alive:
+		if !known || inc > curInc {
+			m.setMember(update)
+		}
+	case Suspect:
+		if !known || (cur.State == Alive && inc >= curInc) || (cur.State != Dead && inc > curInc) {
+			m.setMember(update)
+		}
+	case Dead:
+		if !known || (cur.State != Dead && inc >= curInc) {
+			m.setMember(update)
+		}
+	}
+}
+
+func (m *Membership) mergeAll(updates []Member) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, u := range updates {
+		m.merge(u)
+	}
+}
+
+// Ping is the direct probe, it also carries gossip both ways
+func (m *Membership) Ping(req *PingRequest, resp *PingResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.merge(req.From)
+	for _, u := range req.Updates {
+		m.merge(u)
+	}
+	*resp = PingResponse{
+		Updates: m.piggyback(),
+	}
+	return nil
+}
+
+// PingReq probes the target on behalf of a member that could not reach it directly
+func (m *Membership) PingReq(req *PingReqRequest, resp *PingResponse) error {
+	m.mergeAll(append(req.Updates, req.From))
+	if err := m.ping(req.Target); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	*resp = PingResponse{
+		Updates: m.piggyback(),
+	}
+	return nil
+}
+
+// Sync exchanges the full member list, joining nodes call it on a seed
+func (m *Membership) Sync(req *SyncRequest, resp *SyncResponse) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.merge(req.From)
+	*resp = SyncResponse{
+		Members: []Member{},
+	}
+	for _, member := range m.members {
+		resp.Members = append(resp.Members, member)
+	}
+	return nil
+}
+
+func (m *Membership) ping(addr string) error {
+	m.mu.Lock()
+	req := PingRequest{
+		From: m.self,
+		Updates: m.piggyback(),
+	}
+	m.mu.Unlock()
+	resp := new(PingResponse)
+	if err := m.Transport.Call(addr, "Membership.Ping", &req, resp, m.Config.PingTimeout); err != nil {
+		return err
+	}
+	m.mergeAll(resp.Updates)
+	return nil
+}
+
+// Join fetches the member list from the first seed that answers and announces this node
+func (m *Membership) Join(seeds []string) error {
+	err := fmt.Errorf("no seed to join through")
+	for _, seed := range seeds {
+		if seed == m.self.Addr() {
+			continue
+		}
+		m.mu.Lock()
+		req := SyncRequest{
+			From: m.self,
+		}
+		m.mu.Unlock()
+		resp := new(SyncResponse)
+		if err = m.Transport.Call(seed, "Membership.Sync", &req, resp, m.Config.PingTimeout * 3); err != nil {
+			log.Printf("could not join membership through [%s]: %v", seed, err)
+			continue
+		}
+		m.mergeAll(resp.Members)
+		m.mu.Lock()
+		m.queue(m.self)
+		m.mu.Unlock()
+		log.Printf("joined membership through [%s] with [%d] members", seed, len(resp.Members))
+		return nil
+	}
+	return err
+}
+
+// picks the next member to probe, must be called with m.mu held
+func (m *Membership) nextTarget() string {
+	for attempt := 0; attempt < 2; attempt++ {
+		for len(m.probeOrder) > 0 {
+			addr := m.probeOrder[0]
+			m.probeOrder = m.probeOrder[1:]
+			if member, ok := m.members[addr]; ok && member.State != Dead && addr != m.self.Addr() {
+				return addr
+			}
+		}
+		for addr, member := range m.members {
+			if member.State != Dead && addr != m.self.Addr() {
+				m.probeOrder = append(m.probeOrder, addr)
+			}
+		}
+		rand.Shuffle(len(m.probeOrder), func(i, j int) {
+			m.probeOrder[i], m.probeOrder[j] = m.probeOrder[j], m.probeOrder[i]
+		})
+	}
+	return ""
+}
+
+// asks up to IndirectProbes other members to ping the target, true if any of them reached it
+func (m *Membership) probeIndirectly(target string) bool {
+	m.mu.Lock()
+	helpers := []string{}
+	for addr, member := range m.members {
+		if member.State == Alive && addr != target && addr != m.self.Addr() {
+			helpers = append(helpers, addr)
+		}
+	}
+	rand.Shuffle(len(helpers), func(i, j int) {
+		helpers[i], helpers[j] = helpers[j], helpers[i]
+	})
+	if len(helpers) > m.Config.IndirectProbes {
+		helpers = helpers[:m.Config.IndirectProbes]
+	}
+	req := PingReqRequest{
+		From: m.self,
+		Target: target,
+		Updates: m.piggyback(),
+	}
+	m.mu.Unlock()
+
+	acks := make(chan bool, len(helpers))
+	for _, helper := range helpers {
+		go func(helper string) {
+			resp := new(PingResponse)
+			err := m.Transport.Call(helper, "Membership.PingReq", &req, resp, m.Config.ProtocolPeriod)
+			if err == nil {
+				m.mergeAll(resp.Updates)
+			}
+			acks <- err == nil
+		}(helper)
+	}
+	for range helpers {
+		if <-acks {
+			return true
+		}
+	}
+	return false
+}
+
+// runs one protocol period: probe a member, then declare expired suspects dead
+func (m *Membership) tick() {
+	m.mu.Lock()
+	target := m.nextTarget()
+	m.mu.Unlock()
+
+	if target != "" && m.ping(target) != nil && !m.probeIndirectly(target) {
+		m.mu.Lock()
+		if member, ok := m.members[target]; ok && member.State == Alive {
+			member.State = Suspect
+			m.setMember(member)
+		}
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for addr, since := range m.suspectedAt {
+		if time.Since(since) < m.Config.SuspicionTimeout {
+			continue
+		}
+		member := m.members[addr]
+		member.State = Dead
+		m.setMember(member)
+	}
+}
+
+// must be called with m.mu held
+func (m *Membership) alone() bool {
+	for addr, member := range m.members {
+		if addr != m.self.Addr() && member.State != Dead {
+			return false
+		}
+	}
+	return true
+}
+
+// Start probes a member every protocol period until Stop is called. While this node knows
+// nobody else, e.g. because it started before the seeds, it keeps trying to join through them.
+func (m *Membership) Start(seeds []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	go m.run(seeds, m.stop)
+}
+
+// Stop ends the protocol loop, the node keeps answering probes as long as its rpc server runs
+func (m *Membership) Stop() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		close(m.stop)
+		m.stop = nil
+	}
+}
+
+func (m *Membership) run(seeds []string, stop chan struct{}) {
+	ticker := time.NewTicker(m.Config.ProtocolPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		m.mu.Lock()
+		alone := m.alone()
+		m.mu.Unlock()
+		if alone {
+			m.Join(seeds)
+			continue
+		}
+		m.tick()
+	}
+}
@@ -0,0 +1,113 @@
+// Package merkle summarizes the versions a replica stores in a hash tree of fixed shape, so two
+// replicas find where their sets differ by exchanging only the hashes along the paths that differ.
+package merkle
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"sort"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+const (
+	// children of every inner node
+	Fanout = 16
+	// levels below the root, the tree has Fanout^Depth leaves
+	Depth = 2
+)
+
+// Leaves is the number of buckets the versions are spread over
+func Leaves() int {
+	leaves := 1
+	for i := 0; i < Depth; i++ {
+		leaves *= Fanout
+	}
+	return leaves
+}
+
+// Bucket is the leaf every version of a file falls into
+func Bucket(name string) int {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return int(h.Sum32() % uint32(Leaves()))
+}
+
+// Children are the indexes of the nodes below node index one level down
+func Children(index int) []int {
+	output := []int{}
+	for i := 0; i < Fanout; i++ {
+		output = append(output, index * Fanout + i)
+	}
+	return output
+}
+
+type Tree struct {
+	// levels[0] holds the root, levels[Depth] the leaves
+	levels [][]string
+	buckets [][]common.StoredVersion
+}
+
+// New builds the tree over a set of versions
+func New(versions []common.StoredVersion) *Tree {
+	t := &Tree{
+		buckets: make([][]common.StoredVersion, Leaves()),
+	}
+	for _, v := range versions {
+		b := Bucket(v.Name)
+		t.buckets[b] = append(t.buckets[b], v)
+	}
+	leaves := []string{}
+	for _, bucket := range t.buckets {
+		sort.Slice(bucket, func(i, j int) bool {
+			if bucket[i].Name != bucket[j].Name {
+				return bucket[i].Name < bucket[j].Name
+			}
+			return bucket[i].Version < bucket[j].Version
+		})
+		h := sha256.New()
+		for _, v := range bucket {
+			fmt.Fprintf(h, "%s\x00%d\x00%s\n", v.Name, v.Version, v.Checksum)
+		}
+		leaves = append(leaves, hex.EncodeToString(h.Sum(nil)))
+	}
+	t.levels = make([][]string, Depth + 1)
+	t.levels[Depth] = leaves
+	for level := Depth - 1; level >= 0; level-- {
+		below := t.levels[level + 1]
+		for i := 0; i < len(below) / Fanout; i++ {
+			h := sha256.New()
+			for _, child := range below[i * Fanout : (i + 1) * Fanout] {
+				h.Write([]byte(child))
+			}
+			t.levels[level] = append(t.levels[level], hex.EncodeToString(h.Sum(nil)))
+		}
+	}
+	return t
+}
+
+// Hashes returns the hashes of the nodes at indexes of a level, out of range nodes hash to ""
+func (t *Tree) Hashes(level int, indexes []int) []string {
+	output := []string{}
+	for _, i := range indexes {
+		if level < 0 || level > Depth || i < 0 || i >= len(t.levels[level]) {
+			output = append(output, "")
+			continue
+		}
+		output = append(output, t.levels[level][i])
+	}
+	return output
+}
+
+// Versions returns every version in the given leaves
+func (t *Tree) Versions(leaves []int) []common.StoredVersion {
+	output := []common.StoredVersion{}
+	for _, i := range leaves {
+		if i >= 0 && i < len(t.buckets) {
+			output = append(output, t.buckets[i]...)
+		}
+	}
+	return output
+}
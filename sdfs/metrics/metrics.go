@@ -0,0 +1,70 @@
+// Package metrics keeps the counters of one node. Every coordinator and replica serves its
+// counters over rpc and as json on /metrics of its rpc port.
+package metrics
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+)
+
+// names of the counters
+const (
+	// versions a replica pushed to a replica a get found behind
+	ReadRepairs = "read_repairs"
+	ReadRepairFailures = "read_repair_failures"
+	// versions a replica pulled from a peer during anti-entropy
+	AntiEntropyPulls = "anti_entropy_pulls"
+	// versions a scrub rehashed and versions it found corrupt or missing
+	ScrubbedVersions = "scrubbed_versions"
+	ScrubFailures = "scrub_failures"
+	// corrupt or missing copies the coordinator replaced
+	ChunkRepairs = "chunk_repairs"
+	// hints a replica took, replayed to their target, or dropped because the target left the ring
+	HintsStored = "hints_stored"
+	HintsReplayed = "hints_replayed"
+	HintsExpired = "hints_expired"
+	// work the coordinator queued after it failed, and queued work it gave up on
+	RetriesQueued = "retries_queued"
+	RetriesAbandoned = "retries_abandoned"
+)
+
+type Counters struct {
+	values map[string]int64
+	mu sync.Mutex
+}
+
+func New() *Counters {
+	return &Counters{
+		values: map[string]int64{},
+	}
+}
+
+func (c *Counters) Add(name string, delta int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[name] += delta
+}
+
+func (c *Counters) Get(name string) int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[name]
+}
+
+// Snapshot copies every counter
+func (c *Counters) Snapshot() map[string]int64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	output := map[string]int64{}
+	for name, value := range c.values {
+		output[name] = value
+	}
+	return output
+}
+
+// ServeHTTP writes the counters as json
+func (c *Counters) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c.Snapshot())
+}
@@ -0,0 +1,234 @@
+package replica
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/merkle"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+)
+
+const (
+	DefaultAntiEntropyInterval = 1 * time.Minute
+)
+
+// builds the Merkle tree over every version of the chunks this replica stores
+func (s *Replica) merkleTree(chunks []string) (*merkle.Tree, error) {
+	versions := []common.StoredVersion{}
+	for _, name := range chunks {
+		stored, err := s.Store.Versions(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, version := range stored {
+			checksum, err := s.Store.VersionChecksum(name, version)
+			if err != nil {
+				return nil, err
+			}
+			versions = append(versions, common.StoredVersion{
+				Name: name,
+				Version: version,
+				Checksum: checksum,
+			})
+		}
+	}
+	return merkle.New(versions), nil
+}
+
+// MerkleHashes answers a peer walking down the tree of the chunks both of them hold
+func (s *Replica) MerkleHashes(req *common.MerkleHashesRequest, resp *common.MerkleHashesResponse) error {
+	tree, err := s.merkleTree(req.Chunks)
+	if err != nil {
+		return err
+	}
+	*resp = common.MerkleHashesResponse{
+		Hashes: tree.Hashes(req.Level, req.Indexes),
+	}
+	return nil
+}
+
+// MerkleVersions lists the versions in the leaves where a peer found the trees differ
+func (s *Replica) MerkleVersions(req *common.MerkleVersionsRequest, resp *common.MerkleVersionsResponse) error {
+	tree, err := s.merkleTree(req.Chunks)
+	if err != nil {
+		return err
+	}
+	*resp = common.MerkleVersionsResponse{
+		Versions: tree.Versions(req.Leaves),
+	}
+	return nil
+}
+
+// walks the peer's tree from the root down through the nodes that differ from the local tree
+// and returns the leaves that differ
+func (s *Replica) diffLeaves(peer string, chunks []string, local *merkle.Tree) ([]int, error) {
+	differing := []int{0}
+	for level := 0; ; level++ {
+		req := common.MerkleHashesRequest{
+			Chunks: chunks,
+			Level: level,
+			Indexes: differing,
+		}
+		resp := new(common.MerkleHashesResponse)
+		if err := s.Transport.Call(peer, "Replica.MerkleHashes", &req, resp, RequestTimeout); err != nil {
+			return nil, err
+		}
+		if len(resp.Hashes) != len(differing) {
+			return nil, fmt.Errorf("[%s] sent [%d] hashes for [%d] nodes", peer, len(resp.Hashes), len(differing))
+		}
+		mine := local.Hashes(level, differing)
+		next := []int{}
+		for k, i := range differing {
+			if resp.Hashes[k] == mine[k] {
+				continue
+			}
+			if level == merkle.Depth {
+				next = append(next, i)
+			} else {
+				next = append(next, merkle.Children(i)...)
+			}
+		}
+		if level == merkle.Depth || len(next) == 0 {
+			return next, nil
+		}
+		differing = next
+	}
+}
+
+// copies one version from a peer, the store refuses it unless it matches the checksum. The copy is
+// staged under an upload of its own, a failed pull only throws away what it wrote itself.
+func (s *Replica) pullVersion(peer string, v common.StoredVersion) error {
+	upload := common.NewUploadID()
+	var offset int64
+	for {
+		req := common.ReadBlockRequest{
+			Name: v.Name,
+			Version: v.Version,
+			Offset: offset,
+			Length: common.BlockSize,
+		}
+		resp := new(common.ReadBlockResponse)
+		if err := s.Transport.Call(peer, "Replica.ReadBlock", &req, resp, RequestTimeout); err != nil {
+			s.Store.Discard(v.Name, v.Version, upload)
+			return err
+		}
+		if err := s.Store.WriteBlock(v.Name, v.Version, upload, offset, resp.Data); err != nil {
+			s.Store.Discard(v.Name, v.Version, upload)
+			return err
+		}
+		offset += int64(len(resp.Data))
+		if resp.EOF || len(resp.Data) == 0 {
+			break
+		}
+	}
+	if err := s.Store.Commit(v.Name, v.Version, upload, offset, v.Checksum); err != nil {
+		s.Store.Discard(v.Name, v.Version, upload)
+		return err
+	}
+	return nil
+}
+
+// reconciles the chunks this replica shares with one peer, pulling every version the peer has and
+// this replica lacks. The peer does the same the other way round, so both end up with the union of
+// the versions the manifests keep. A version the manifest does not keep with that checksum is left
+// alone, the peer may have missed a delete and still hold what a new put replaced.
+func (s *Replica) reconcile(peer string, assigned []common.AssignedChunk) (int, error) {
+	chunks := []string{}
+	for _, chunk := range assigned {
+		chunks = append(chunks, chunk.Name)
+	}
+	sort.Strings(chunks)
+	local, err := s.merkleTree(chunks)
+	if err != nil {
+		return 0, err
+	}
+	leaves, err := s.diffLeaves(peer, chunks, local)
+	if err != nil || len(leaves) == 0 {
+		return 0, err
+	}
+	req := common.MerkleVersionsRequest{
+		Chunks: chunks,
+		Leaves: leaves,
+	}
+	resp := new(common.MerkleVersionsResponse)
+	if err := s.Transport.Call(peer, "Replica.MerkleVersions", &req, resp, RequestTimeout); err != nil {
+		return 0, err
+	}
+	have := map[string]string{}
+	for _, v := range local.Versions(leaves) {
+		have[fmt.Sprintf("%s/%d", v.Name, v.Version)] = v.Checksum
+	}
+	pulled := 0
+	for _, v := range resp.Versions {
+		checksum, ok := have[fmt.Sprintf("%s/%d", v.Name, v.Version)]
+		if ok {
+			if checksum != v.Checksum {
+				// one of the copies is corrupt, the scrubbers find out which
+				log.Printf("[%s] version [%d] differs between [%s] and [%s]", v.Name, v.Version, s.Self.Addr(), peer)
+			}
+			continue
+		}
+		if !versionAssigned(v.Name, v.Version, v.Checksum, assigned) {
+			log.Printf("not pulling [%s] version [%d] from [%s], the manifest does not keep it", v.Name, v.Version, peer)
+			continue
+		}
+		if err := s.pullVersion(peer, v); err != nil {
+			log.Printf("could not pull [%s] version [%d] from [%s]: %v", v.Name, v.Version, peer, err)
+			continue
+		}
+		log.Printf("pulled [%s] version [%d] from [%s]", v.Name, v.Version, peer)
+		s.Counters.Add(metrics.AntiEntropyPulls, 1)
+		pulled += 1
+	}
+	return pulled, nil
+}
+
+// one anti-entropy round with every replica that shares a chunk with this one
+func (s *Replica) antiEntropy() {
+	req := common.AssignedRequest{
+		Address: s.Self.Addr(),
+	}
+	resp := new(common.AssignedResponse)
+	if err := s.Coordinators.Call("Coordinator.Assigned", &req, resp, RequestTimeout); err != nil {
+		log.Printf("could not start anti-entropy on [%s]: %v", s.Self.Addr(), err)
+		return
+	}
+	shared := map[string][]common.AssignedChunk{}
+	for _, chunk := range resp.Chunks {
+		for _, r := range chunk.Replicas {
+			if r != s.Self.Addr() {
+				shared[r] = append(shared[r], chunk)
+			}
+		}
+	}
+	for peer, chunks := range shared {
+		pulled, err := s.reconcile(peer, chunks)
+		if err != nil {
+			log.Printf("could not reconcile [%d] chunks with [%s]: %v", len(chunks), peer, err)
+			continue
+		}
+		if pulled > 0 {
+			log.Printf("pulled [%d] versions from [%s]", pulled, peer)
+		}
+	}
+}
+
+// runs an anti-entropy round every AntiEntropyInterval
+func (s *Replica) runAntiEntropy(stop chan struct{}) {
+	if s.AntiEntropyInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.AntiEntropyInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		s.antiEntropy()
+	}
+}
@@ -0,0 +1,71 @@
+package replica_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/faults"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/testcluster"
+)
+
+// a replica that missed the delete of a file still holds its old versions, its peers do not pull
+// them into the file put again since
+func TestMissedDeleteNotPulled(t *testing.T) {
+	options := testcluster.DefaultOptions()
+	options.AntiEntropyInterval = 200 * time.Millisecond
+	c := testcluster.Start(t, options)
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+	for _, content := range []string{"first", "second"} {
+		if err := testcluster.Put(t, cl, "a", content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stale := c.Holder(t, "a", writer)
+
+	leader, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the stale replica prepares the delete but never hears it committed, and gets no block of the next put
+	c.Network.Add(faults.Rule{
+		From: leader.Self.Addr(),
+		To: stale.Self.Addr(),
+		Method: "Replica.Commit",
+		Cut: true,
+	})
+	for _, n := range c.Replicas {
+		c.Network.Add(faults.Rule{
+			From: n.Self.Addr(),
+			To: stale.Self.Addr(),
+			Method: "Replica.",
+			Cut: true,
+		})
+	}
+	if err := cl.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := testcluster.Put(t, cl, "a", "third"); err != nil {
+		t.Fatal(err)
+	}
+	if versions, err := stale.Replica.Store.Versions("a#0"); err != nil || len(versions) != 2 {
+		t.Fatalf("[%s] holds versions %v, %v of [a], want the two from before the delete", stale.Name, versions, err)
+	}
+
+	c.Network.Heal()
+	// a few anti-entropy rounds
+	time.Sleep(2 * time.Second)
+	for _, n := range c.Replicas {
+		if n == stale {
+			continue
+		}
+		versions, err := n.Replica.Store.Versions("a#0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(versions) > 1 {
+			t.Fatalf("[%s] pulled versions %v of [a], only version [1] was put since the delete", n.Name, versions)
+		}
+	}
+	testcluster.Expect(t, cl, "a", -1, "third")
+}
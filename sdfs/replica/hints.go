@@ -0,0 +1,184 @@
+package replica
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+)
+
+const (
+	// hints live in <data dir>/hints, one json file per hint
+	HintsDir = "hints"
+	DefaultHintReplayInterval = 5 * time.Second
+	// hints older than this are dropped, anti-entropy brings the target up to date by then
+	HintTTL = time.Hour
+)
+
+func (s *Replica) hintPath(hint common.Hint) string {
+	name := fmt.Sprintf("%s_%s_%d.json", url.PathEscape(hint.Target), url.PathEscape(hint.Name), hint.Version)
+	return filepath.Join(s.DataDir, HintsDir, name)
+}
+
+// StoreHint keeps a version another replica missed until it can be replayed, the hint survives restarts
+func (s *Replica) StoreHint(req *common.Hint, resp *common.HintAck) error {
+	versions, err := s.Store.Versions(req.Name)
+	if err != nil {
+		return err
+	}
+	stored := false
+	for _, version := range versions {
+		if version == req.Version {
+			stored = true
+		}
+	}
+	if !stored {
+		return fmt.Errorf("[%s] version [%d] is not stored on [%s]", req.Name, req.Version, s.Self.Addr())
+	}
+	data, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(s.DataDir, HintsDir), 0755); err != nil {
+		return err
+	}
+	// write through a temporary file so a crash never leaves half a hint behind
+	path := s.hintPath(*req)
+	if err := os.WriteFile(path + ".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(path + ".tmp", path); err != nil {
+		return err
+	}
+	s.Counters.Add(metrics.HintsStored, 1)
+	log.Printf("holding hint of [%s] version [%d] for [%s]", req.Name, req.Version, req.Target)
+	return nil
+}
+
+// reads every hint this replica holds and when it was stored
+func (s *Replica) hints() ([]common.Hint, []time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(s.DataDir, HintsDir))
+	if os.IsNotExist(err) {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	output := []common.Hint{}
+	stored := []time.Time{}
+	for _, e := range entries {
+		if !strings.HasSuffix(e.Name(), ".json") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil {
+			return nil, nil, err
+		}
+		data, err := os.ReadFile(filepath.Join(s.DataDir, HintsDir, e.Name()))
+		if err != nil {
+			return nil, nil, err
+		}
+		hint := common.Hint{}
+		if err := json.Unmarshal(data, &hint); err != nil {
+			log.Printf("dropping unreadable hint [%s]: %v", e.Name(), err)
+			os.Remove(filepath.Join(s.DataDir, HintsDir, e.Name()))
+			continue
+		}
+		output = append(output, hint)
+		// hints are written once, the file is as old as the hint
+		stored = append(stored, info.ModTime())
+	}
+	return output, stored, nil
+}
+
+// whether the target still needs the hinted version: the coordinator has to assign it the chunk and
+// keep the version with the same checksum in the manifest. A hint goes stale when the file is deleted,
+// deleted and put again under the same version numbers, or when the chunk moves off the target.
+func hintWanted(hint common.Hint, assigned []common.AssignedChunk) bool {
+	return versionAssigned(hint.Name, hint.Version, hint.Checksum, assigned)
+}
+
+// whether the manifest keeps a version of a chunk with this checksum
+func versionAssigned(name string, version int, checksum string, assigned []common.AssignedChunk) bool {
+	for _, chunk := range assigned {
+		if chunk.Name != name {
+			continue
+		}
+		kept, ok := chunk.Checksums[version]
+		return ok && kept == checksum
+	}
+	return false
+}
+
+func (s *Replica) dropHint(hint common.Hint, reason string) {
+	log.Printf("dropping hint of [%s] version [%d] for [%s]: %s", hint.Name, hint.Version, hint.Target, reason)
+	os.Remove(s.hintPath(hint))
+	s.Counters.Add(metrics.HintsExpired, 1)
+}
+
+// replays every hint the coordinator confirms is still wanted and whose target answers. Hints the
+// coordinator no longer wants and hints older than HintTTL are dropped.
+func (s *Replica) replayHints() {
+	hints, stored, err := s.hints()
+	if err != nil {
+		log.Printf("could not read hints: %v", err)
+		return
+	}
+	// what each target is assigned, asked once per round
+	assignments := map[string][]common.AssignedChunk{}
+	for i, hint := range hints {
+		if time.Since(stored[i]) > HintTTL {
+			s.dropHint(hint, fmt.Sprintf("older than %s", HintTTL))
+			continue
+		}
+		assigned, ok := assignments[hint.Target]
+		if !ok {
+			req := common.AssignedRequest{
+				Address: hint.Target,
+			}
+			resp := new(common.AssignedResponse)
+			if err := s.Coordinators.Call("Coordinator.Assigned", &req, resp, RequestTimeout); err != nil {
+				// without the coordinator a stale hint cannot be told apart, try again next round
+				log.Printf("could not check the hints for [%s]: %v", hint.Target, err)
+				continue
+			}
+			assigned = resp.Chunks
+			assignments[hint.Target] = assigned
+		}
+		if !hintWanted(hint, assigned) {
+			s.dropHint(hint, "the target is no longer assigned that version")
+			continue
+		}
+		if err := s.pushVersion(hint.Target, hint.Name, hint.Version, hint.Checksum); err != nil {
+			// most likely still down, try again next round
+			continue
+		}
+		log.Printf("replayed hint of [%s] version [%d] to [%s]", hint.Name, hint.Version, hint.Target)
+		os.Remove(s.hintPath(hint))
+		s.Counters.Add(metrics.HintsReplayed, 1)
+	}
+}
+
+// replays the hints every HintReplayInterval
+func (s *Replica) runHintReplay(stop chan struct{}) {
+	if s.HintReplayInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.HintReplayInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		s.replayHints()
+	}
+}
@@ -0,0 +1,86 @@
+package replica_test
+
+import (
+	"testing"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/faults"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/testcluster"
+)
+
+// starts a cluster and puts a file that one of its replicas misses, returns the replica missing it
+func putMissingOne(t *testing.T) (*testcluster.Cluster, *testcluster.Node) {
+	options := testcluster.DefaultOptions()
+	options.HintReplayInterval = 200 * time.Millisecond
+	c := testcluster.Start(t, options)
+	writer := c.Replicas[0]
+	cl := c.Client(writer)
+	if err := testcluster.Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	target := c.Holder(t, "a", writer)
+
+	// the target neither gets the blocks of the next put nor its hints yet, the coordinator still reaches it
+	for _, n := range c.Replicas {
+		c.Network.Add(faults.Rule{
+			From: n.Self.Addr(),
+			To: target.Self.Addr(),
+			Method: "Replica.",
+			Cut: true,
+		})
+	}
+	if err := testcluster.Put(t, cl, "a", "second"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.WaitFor(func() bool {
+		return counter(c, metrics.HintsStored) > 0
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("no hint was stored: %v", err)
+	}
+	return c, target
+}
+
+// sum of a counter over every replica
+func counter(c *testcluster.Cluster, name string) int64 {
+	var sum int64
+	for _, n := range c.Replicas {
+		sum += n.Replica.Counters.Get(name)
+	}
+	return sum
+}
+
+func TestHintReplayed(t *testing.T) {
+	c, target := putMissingOne(t)
+	c.Network.Heal()
+	err := c.WaitFor(func() bool {
+		versions, err := target.Replica.Store.Versions("a#0")
+		return err == nil && len(versions) > 0 && versions[len(versions) - 1] == 2 && counter(c, metrics.HintsReplayed) > 0
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the hint was not replayed to [%s]: %v", target.Name, err)
+	}
+}
+
+// a hint for a version deleted since it was stored is dropped instead of retried forever
+func TestStaleHintDropped(t *testing.T) {
+	c, target := putMissingOne(t)
+	if err := c.Client(c.Replicas[0]).Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	err := c.WaitFor(func() bool {
+		return counter(c, metrics.HintsExpired) > 0
+	}, testcluster.DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the stale hint was not dropped: %v", err)
+	}
+	c.Network.Heal()
+	time.Sleep(time.Second)
+	if counter(c, metrics.HintsReplayed) != 0 {
+		t.Fatalf("a hint of a deleted file was replayed")
+	}
+	if versions, err := target.Replica.Store.Versions("a#0"); err == nil && len(versions) > 0 {
+		t.Fatalf("[%s] holds versions %v of a deleted file", target.Name, versions)
+	}
+}
@@ -1,25 +1,79 @@
 package replica
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/rpc"
+	"sync"
+	"time"
 
 	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/storage"
 )
 
 const (
 	DefaultPort = 60221
+	DefaultDataDir = "/tmp/sdfs"
+	RequestTimeout = 1 * time.Second
+	StagingTimeout = 10 * time.Minute
 )
 
 type Replica struct {
 	Self common.Node
 	Port int
+	DataDir string
+	Store *storage.Store
+	Coordinators *common.Coordinators
+	Membership *membership.Membership
+	// how other replicas are reached
+	Transport common.Transport
+	// time between two scrubs of the stored chunks and the bytes per second a scrub reads
+	ScrubInterval time.Duration
+	ScrubRate int64
+	// time between two anti-entropy rounds with the replicas sharing a chunk with this one
+	AntiEntropyInterval time.Duration
+	// time between two attempts to replay the hints this replica holds for others
+	HintReplayInterval time.Duration
+	Counters *metrics.Counters
+	// version of every file a delete was prepared for but not yet committed or rolled back
+	pendingDeletes map[string]int
+	// closed to stop the background loops
+	stop chan struct{}
+	mu sync.Mutex
+}
+
+func NewReplica(self common.Node, port int, dataDir string, coordinators *common.Coordinators, members *membership.Membership) (*Replica, error) {
+	store, err := storage.NewStore(dataDir)
+	if err != nil {
+		return nil, err
+	}
+	return &Replica{
+		Self: self,
+		Port: port,
+		DataDir: dataDir,
+		Store: store,
+		Coordinators: coordinators,
+		Membership: members,
+		Transport: common.DefaultTransport,
+		ScrubInterval: DefaultScrubInterval,
+		ScrubRate: DefaultScrubRate,
+		AntiEntropyInterval: DefaultAntiEntropyInterval,
+		HintReplayInterval: DefaultHintReplayInterval,
+		Counters: metrics.New(),
+		pendingDeletes: map[string]int{},
+	}, nil
 }
 
 func (s *Replica) FDAck(req *common.FDPing, resp *common.FDAck) error {
+	if req.Leader != "" {
+		s.Coordinators.SetLeader(req.Leader)
+	}
 	return nil
 }
 
@@ -28,19 +82,282 @@ func (s *Replica) Failure(req *common.Failure, resp *common.FailureDetectedAck)
 	return nil
 }
 
+// ReceiveReplication is called on the destination once the source pushed a file group to it,
+// it only acks when the newest version of the group is stored here
 func (s *Replica) ReceiveReplication(req *common.Replication, resp *common.ReplicationReceivedAck) error {
-	log.Printf("Received file [%s] from [%s]", req.Name, req.Source)
-	return nil
+	versions, err := s.Store.Versions(req.Name)
+	if err != nil {
+		return err
+	}
+	for _, version := range versions {
+		if version == req.Version {
+			log.Printf("received file [%s] from [%s], [%d] versions", req.Name, req.Source, len(versions))
+			return nil
+		}
+	}
+	return fmt.Errorf("[%s] version [%d] from [%s] is missing on [%s]", req.Name, req.Version, req.Source, s.Self.Addr())
 }
 
+// pushes one stored version to another replica, the destination verifies size and checksum before committing it.
+// A copy that does not match the expected checksum is reported instead of spread.
+func (s *Replica) pushVersion(addr string, name string, version int, expected string) error {
+	f, _, err := s.Store.Open(name, version)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	checksum, err := storage.Checksum(f)
+	if err != nil {
+		return err
+	}
+	if expected != "" && checksum != expected {
+		s.reportCorruption(name, version)
+		return fmt.Errorf("[%s] version [%d] on [%s] has checksum [%s], expected [%s]", name, version, s.Self.Addr(), checksum, expected)
+	}
+	upload := common.NewUploadID()
+	buf := make([]byte, common.BlockSize)
+	var offset int64
+	for {
+		n, err := f.ReadAt(buf, offset)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if n > 0 || offset == 0 {
+			block := common.WriteBlockRequest{
+				Name: name,
+				Version: version,
+				UploadID: upload,
+				Offset: offset,
+				Data: buf[:n],
+			}
+			if err := s.Transport.Call(addr, "Replica.WriteBlock", &block, new(common.WriteBlockAck), RequestTimeout); err != nil {
+				return err
+			}
+			offset += int64(n)
+		}
+		if err == io.EOF {
+			break
+		}
+	}
+	commit := common.CommitWriteRequest{
+		Name: name,
+		Version: version,
+		UploadID: upload,
+		Size: offset,
+		Checksum: checksum,
+	}
+	return s.Transport.Call(addr, "Replica.CommitWrite", &commit, new(common.CommitWriteAck), common.FlushTimeout(RequestTimeout, offset))
+}
+
+// SendReplication is called on the source and copies every stored version of the file group to the destination
 func (s* Replica) SendReplication(req *common.Replication, resp *common.ReplicationSentAck) error {
-	log.Printf("Sending file [%s] to [%s]", req.Name, req.Destination)
+	log.Printf("sending file [%s] to [%s]", req.Name, req.Destination)
+	versions, err := s.Store.Versions(req.Name)
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		return fmt.Errorf("[%s] is not stored on [%s]", req.Name, s.Self.Addr())
+	}
+	for _, version := range versions {
+		if err := s.pushVersion(req.Destination, req.Name, version, req.Checksums[version]); err != nil {
+			return fmt.Errorf("copying [%s] version [%d] to [%s]: %w", req.Name, version, req.Destination, err)
+		}
+	}
+	log.Printf("sent [%d] versions of [%s] to [%s]", len(versions), req.Name, req.Destination)
+	return nil
+}
+
+// tells the coordinator the local copy of a version is corrupt so it gets replaced
+func (s *Replica) reportCorruption(name string, version int) {
+	report := common.CorruptionReport{
+		Name: name,
+		Version: version,
+		Replica: s.Self.Addr(),
+	}
+	if err := s.Coordinators.Call("Coordinator.ReportCorruption", &report, new(common.CorruptionAck), RequestTimeout); err != nil {
+		log.Printf("could not report corrupt [%s] version [%d]: %v", name, version, err)
+	}
+}
+
+// ReadRepair pushes a version to a replica a get found behind, in the background so the get is not held up
+func (s *Replica) ReadRepair(req *common.ReadRepairRequest, resp *common.ReadRepairAck) error {
+	go func() {
+		if err := s.pushVersion(req.Destination, req.Name, req.Version, req.Checksum); err != nil {
+			log.Printf("could not repair [%s] version [%d] on [%s]: %v", req.Name, req.Version, req.Destination, err)
+			s.Counters.Add(metrics.ReadRepairFailures, 1)
+			return
+		}
+		log.Printf("repaired [%s] version [%d] on [%s]", req.Name, req.Version, req.Destination)
+		s.Counters.Add(metrics.ReadRepairs, 1)
+	}()
+	return nil
+}
+
+func (s *Replica) Metrics(req *common.MetricsRequest, resp *common.MetricsResponse) error {
+	*resp = s.Counters.Snapshot()
 	return nil
 }
 
+func (s *Replica) WriteBlock(req *common.WriteBlockRequest, resp *common.WriteBlockAck) error {
+	return s.Store.WriteBlock(req.Name, req.Version, req.UploadID, req.Offset, req.Data)
+}
+
+func (s *Replica) CommitWrite(req *common.CommitWriteRequest, resp *common.CommitWriteAck) error {
+	if err := s.Store.Commit(req.Name, req.Version, req.UploadID, req.Size, req.Checksum); err != nil {
+		return storeError(err)
+	}
+	log.Printf("stored [%s] version [%d] (%d bytes)", req.Name, req.Version, req.Size)
+	return nil
+}
+
+// gives errors of the store the code callers act on
+func storeError(err error) error {
+	switch {
+	case errors.Is(err, storage.ErrNotFound):
+		return common.Errorf(common.NotFound, "%v", err)
+	case errors.Is(err, storage.ErrMismatch):
+		return common.Errorf(common.Invalid, "%v", err)
+	}
+	return err
+}
+
+func (s *Replica) ReadBlock(req *common.ReadBlockRequest, resp *common.ReadBlockResponse) error {
+	f, version, err := s.Store.Open(req.Name, req.Version)
+	if err != nil {
+		return storeError(err)
+	}
+	defer f.Close()
+	length := req.Length
+	if length <= 0 || length > common.BlockSize {
+		length = common.BlockSize
+	}
+	buf := make([]byte, length)
+	n, err := f.ReadAt(buf, req.Offset)
+	if err != nil && err != io.EOF {
+		return err
+	}
+	*resp = common.ReadBlockResponse{
+		Version: version,
+		Data: buf[:n],
+		EOF: err == io.EOF,
+	}
+	return nil
+}
+
+func (s *Replica) StoredVersions(req *common.StoredVersionsRequest, resp *common.StoredVersionsResponse) error {
+	versions, err := s.Store.Versions(req.Name)
+	if err != nil {
+		return err
+	}
+	*resp = common.StoredVersionsResponse{
+		Versions: versions,
+	}
+	return nil
+}
+
+// Prepare is the first phase of a two-phase commit, the replica promises it can apply the update
+func (s *Replica) Prepare(req *common.FileUpdate, resp *common.P1Ack) error {
+	switch req.OpType {
+	case common.NewFileOp, common.UpdateFileOp:
+		s.mu.Lock()
+		deleting, ok := s.pendingDeletes[req.Name]
+		if ok && req.Version > deleting {
+			// the coordinator kept the file and moved past the deleted version, the rollback of the delete got lost
+			log.Printf("put of [%s] version [%d] supersedes the delete of version [%d]", req.Name, req.Version, deleting)
+			delete(s.pendingDeletes, req.Name)
+			ok = false
+		}
+		s.mu.Unlock()
+		if ok {
+			return common.Errorf(common.Conflict, "[%s] version [%d] is being deleted", req.Name, deleting)
+		}
+		if err := s.Store.Prepare(req.Name, req.Version, req.UploadID, req.Size, req.Checksum); err != nil {
+			return storeError(err)
+		}
+		log.Printf("prepared [%s] version [%d]", req.Name, req.Version)
+	case common.DeleteFileOp:
+		s.mu.Lock()
+		s.pendingDeletes[req.Name] = req.Version
+		s.mu.Unlock()
+		log.Printf("prepared delete of [%s]", req.Name)
+	default:
+		return fmt.Errorf("cannot prepare op [%d] on [%s]", req.OpType, req.Name)
+	}
+	return nil
+}
+
+// Commit is the second phase of a two-phase commit, it makes a prepared update visible
+func (s *Replica) Commit(req *common.FileUpdate, resp *common.P2Ack) error {
+	switch req.OpType {
+	case common.NewFileOp, common.UpdateFileOp:
+		if err := s.Store.Publish(req.Name, req.Version, req.UploadID); err != nil {
+			return err
+		}
+		log.Printf("committed [%s] version [%d]", req.Name, req.Version)
+	case common.DeleteFileOp:
+		s.forgetDelete(req.Name, req.Version)
+		if err := s.Store.Delete(req.Name); err != nil {
+			return err
+		}
+		log.Printf("deleted all versions of file [%s]", req.Name)
+	default:
+		return fmt.Errorf("cannot commit op [%d] on [%s]", req.OpType, req.Name)
+	}
+	return nil
+}
+
+// Rollback undoes a prepared or half-written update
+func (s *Replica) Rollback(req *common.FileUpdate, resp *common.RollbackAck) error {
+	switch req.OpType {
+	case common.NewFileOp, common.UpdateFileOp:
+		if err := s.Store.Abort(req.Name, req.Version, req.UploadID); err != nil {
+			return err
+		}
+	case common.DeleteFileOp:
+		s.forgetDelete(req.Name, req.Version)
+	}
+	log.Printf("rolled back op [%d] on [%s] version [%d]", req.OpType, req.Name, req.Version)
+	return nil
+}
+
+// drops a pending delete once it is committed or rolled back, unless a delete of another version
+// was prepared since
+func (s *Replica) forgetDelete(name string, version int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pendingDeletes[name] == version {
+		delete(s.pendingDeletes, name)
+	}
+}
+
+// periodically drops staged puts whose client went away before the coordinator ran the commit
+func (s *Replica) expireStaging(stop chan struct{}) {
+	ticker := time.NewTicker(StagingTimeout / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		expired, err := s.Store.ExpireStaging(StagingTimeout)
+		if err != nil {
+			log.Printf("could not expire staged files: %v", err)
+			continue
+		}
+		for _, name := range expired {
+			log.Printf("expired staged file [%s]", name)
+		}
+	}
+}
+
 func (s *Replica) ReceiveFileUpdate(req *common.FileUpdate, resp *common.FileUpdateAck) error {
 	switch req.OpType {
 	case common.DeleteFileOp:
+		if err := s.Store.Delete(req.Name); err != nil {
+			return err
+		}
 		log.Printf("deleted all versions of file [%s]", req.Name)
 	case common.NewFileOp:
 		log.Printf("received new file [%s], version [%d]", req.Name, req.Version)
@@ -52,13 +369,55 @@ func (s *Replica) ReceiveFileUpdate(req *common.FileUpdate, resp *common.FileUpd
 	return nil
 }
 
+// Start runs the gossip membership, the cleanup of staged puts, the scrubber, the anti-entropy
+// and the hint replay until Stop is called
+func (s *Replica) Start() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		return
+	}
+	s.stop = make(chan struct{})
+	go s.expireStaging(s.stop)
+	go s.runScrubber(s.stop)
+	go s.runAntiEntropy(s.stop)
+	go s.runHintReplay(s.stop)
+	// the coordinator candidates are the seeds every node joins the gossip through
+	s.Membership.Start(s.Coordinators.Candidates)
+}
+
+func (s *Replica) Stop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stop != nil {
+		close(s.stop)
+		s.stop = nil
+	}
+	s.Membership.Stop()
+}
+
+// Serve starts the replica and answers rpcs on l until it is closed. Every replica gets its own
+// rpc server, so several of them can run in one process.
+func (s *Replica) Serve(l net.Listener) error {
+	server := rpc.NewServer()
+	if err := server.Register(s); err != nil {
+		return err
+	}
+	if err := server.Register(s.Membership); err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle(rpc.DefaultRPCPath, server)
+	mux.Handle("/metrics", s.Counters)
+	s.Start()
+	return http.Serve(l, mux)
+}
+
 func (s* Replica) Run() {
-	log.Printf("starting replica server on [%s]", s.Self.Address)
-	rpc.Register(s)
-	rpc.HandleHTTP()
+	log.Printf("starting replica server on [%s]", s.Self.Addr())
 	l, e := net.Listen("tcp", fmt.Sprintf(":%d", s.Port))
 	if e != nil {
 		log.Fatal("listen error:", e)
 	}
-	defer http.Serve(l, nil)
+	log.Fatal(s.Serve(l))
 }
\ No newline at end of file
@@ -0,0 +1,163 @@
+package replica
+
+import (
+	"errors"
+	"io"
+	"log"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/metrics"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/storage"
+)
+
+const (
+	DefaultScrubInterval = 1 * time.Hour
+	// bytes per second a scrub reads, so it does not starve gets and puts
+	DefaultScrubRate = 16 << 20
+)
+
+// throttle spreads reads so they never go faster than rate bytes per second on average,
+// a rate that is not positive does not limit them
+type throttle struct {
+	rate int64
+	start time.Time
+	read int64
+}
+
+func (t *throttle) wait(n int, stop chan struct{}) bool {
+	t.read += int64(n)
+	if t.rate <= 0 {
+		select {
+		case <- stop:
+			return false
+		default:
+			return true
+		}
+	}
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <- stop:
+			return false
+		case <- time.After(wait):
+		}
+	}
+	return true
+}
+
+// reads through a throttle, a closed stop channel cuts the read short
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+	stop chan struct{}
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > common.BlockSize {
+		p = p[:common.BlockSize]
+	}
+	n, err := r.r.Read(p)
+	if !r.t.wait(n, r.stop) {
+		return n, errScrubStopped
+	}
+	return n, err
+}
+
+var errScrubStopped = errors.New("scrub stopped")
+
+// rehashes one stored version at the scrub rate
+func (s *Replica) scrubVersion(name string, version int, t *throttle, stop chan struct{}) (string, error) {
+	f, _, err := s.Store.Open(name, version)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	return storage.Checksum(&throttledReader{f, t, stop})
+}
+
+// one pass over every chunk the coordinator assigns this replica: versions that are missing or no
+// longer match the checksum their client put them with are reported so the coordinator replaces them
+func (s *Replica) scrub(stop chan struct{}) {
+	req := common.AssignedRequest{
+		Address: s.Self.Addr(),
+	}
+	resp := new(common.AssignedResponse)
+	if err := s.Coordinators.Call("Coordinator.Assigned", &req, resp, RequestTimeout); err != nil {
+		log.Printf("could not start scrub of [%s]: %v", s.Self.Addr(), err)
+		return
+	}
+	t := &throttle{
+		rate: s.ScrubRate,
+		start: time.Now(),
+	}
+	checked, bad := 0, 0
+	for _, chunk := range resp.Chunks {
+		stored, err := s.Store.Versions(chunk.Name)
+		if err != nil {
+			log.Printf("could not list [%s]: %v", chunk.Name, err)
+			continue
+		}
+		has := map[int]struct{}{}
+		for _, version := range stored {
+			has[version] = struct{}{}
+		}
+		for version, expected := range chunk.Checksums {
+			if _, ok := has[version]; !ok {
+				bad += 1
+				s.reportMissing(chunk.Name, version)
+				continue
+			}
+			if expected == "" {
+				continue
+			}
+			checksum, err := s.scrubVersion(chunk.Name, version, t, stop)
+			if err == errScrubStopped {
+				return
+			}
+			if err != nil {
+				log.Printf("could not scrub [%s] version [%d]: %v", chunk.Name, version, err)
+				continue
+			}
+			checked += 1
+			if checksum != expected {
+				bad += 1
+				log.Printf("[%s] version [%d] has checksum [%s], expected [%s]", chunk.Name, version, checksum, expected)
+				s.reportCorruption(chunk.Name, version)
+			}
+		}
+	}
+	s.Counters.Add(metrics.ScrubbedVersions, int64(checked))
+	s.Counters.Add(metrics.ScrubFailures, int64(bad))
+	log.Printf("scrubbed [%d] versions of [%d] chunks on [%s], [%d] need repair", checked, len(resp.Chunks), s.Self.Addr(), bad)
+}
+
+// tells the coordinator a version this replica should hold is not here
+func (s *Replica) reportMissing(name string, version int) {
+	report := common.CorruptionReport{
+		Name: name,
+		Version: version,
+		Replica: s.Self.Addr(),
+		Missing: true,
+	}
+	if err := s.Coordinators.Call("Coordinator.ReportCorruption", &report, new(common.CorruptionAck), RequestTimeout); err != nil {
+		log.Printf("could not report missing [%s] version [%d]: %v", name, version, err)
+	}
+}
+
+// scrubs the stored chunks every ScrubInterval
+func (s *Replica) runScrubber(stop chan struct{}) {
+	if s.ScrubInterval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(s.ScrubInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <- stop:
+			return
+		case <- ticker.C:
+		}
+		s.scrub(stop)
+	}
+}
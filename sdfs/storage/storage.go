@@ -0,0 +1,463 @@
+package storage
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	filesDir = "files"
+	stagingDir = "staging"
+	preparedSuffix = ".prepared"
+	// the checksum of a version is kept next to it so it does not have to be rehashed to be compared
+	checksumSuffix = ".sha256"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// ErrMismatch is returned when staged data does not have the size or checksum it was declared with
+var ErrMismatch = errors.New("staged data does not match")
+
+// Store keeps every version of every sdfs file a replica holds.
+//
+// Committed versions live at <dir>/files/<escaped name>/<version> with their checksum in
+// <version>.sha256, versions that are still being written live at <dir>/staging/<escaped name>.<version>.<upload>
+// until they are committed, with a .prepared suffix once a two-phase commit prepared them. Every upload
+// of a version stages in a file of its own, so two writers of the same version never mix their blocks.
+// Everything is plain files, so a restarted replica picks up exactly what it had on disk.
+type Store struct {
+	dir string
+	mu sync.Mutex
+	// running checksums of the staged copies written in order from the start, keyed by staging path,
+	// so preparing a copy does not read it again
+	hashes map[string]*stagedHash
+	hashesMu sync.Mutex
+}
+
+// the checksum of the first size bytes of a staged copy
+type stagedHash struct {
+	h hash.Hash
+	size int64
+}
+
+func NewStore(dir string) (*Store, error) {
+	for _, sub := range []string{filesDir, stagingDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Store{
+		dir: dir,
+		hashes: map[string]*stagedHash{},
+	}, nil
+}
+
+func escape(name string) (string, error) {
+	if name == "" || name == "." || name == ".." {
+		return "", fmt.Errorf("invalid sdfs file name [%s]", name)
+	}
+	return url.PathEscape(name), nil
+}
+
+func (s *Store) fileDir(name string) (string, error) {
+	escaped, err := escape(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(s.dir, filesDir, escaped), nil
+}
+
+func (s *Store) stagingPath(name string, version int, upload string) (string, error) {
+	escaped, err := escape(name)
+	if err != nil {
+		return "", err
+	}
+	if upload == "" || upload != url.PathEscape(upload) || strings.Contains(upload, ".") {
+		return "", fmt.Errorf("invalid upload id [%s]", upload)
+	}
+	return filepath.Join(s.dir, stagingDir, fmt.Sprintf("%s.%d.%s", escaped, version, upload)), nil
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// WriteBlock writes data at offset into the staged copy of a version an upload writes,
+// the first block starts the copy over
+func (s *Store) WriteBlock(name string, version int, upload string, offset int64, data []byte) error {
+	staged, err := s.stagingPath(name, version, upload)
+	if err != nil {
+		return err
+	}
+	flags := os.O_CREATE|os.O_WRONLY
+	if offset == 0 {
+		flags |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(staged, flags, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, offset)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	s.hashBlock(staged, offset, data, err == nil)
+	return err
+}
+
+// keeps hashing a staged copy as long as its blocks arrive in order, a block written anywhere
+// else or a failed write leaves the copy to be hashed in full when it is prepared
+func (s *Store) hashBlock(staged string, offset int64, data []byte, written bool) {
+	s.hashesMu.Lock()
+	defer s.hashesMu.Unlock()
+	sh, ok := s.hashes[staged]
+	if written && offset == 0 {
+		sh = &stagedHash{h: sha256.New()}
+		s.hashes[staged] = sh
+	} else if !written || !ok || offset != sh.size {
+		delete(s.hashes, staged)
+		return
+	}
+	sh.h.Write(data)
+	sh.size += int64(len(data))
+}
+
+// takes the running checksum of a staged copy, empty unless it covers exactly size bytes
+func (s *Store) stagedSum(staged string, size int64) string {
+	s.hashesMu.Lock()
+	defer s.hashesMu.Unlock()
+	sh, ok := s.hashes[staged]
+	delete(s.hashes, staged)
+	if !ok || sh.size != size {
+		return ""
+	}
+	return hex.EncodeToString(sh.h.Sum(nil))
+}
+
+func (s *Store) forgetSum(staged string) {
+	s.hashesMu.Lock()
+	delete(s.hashes, staged)
+	s.hashesMu.Unlock()
+}
+
+// Prepare checks that a staged version holds exactly size bytes, and hashes to checksum (hex
+// encoded SHA-256) unless it is empty, flushes it and marks it prepared. A prepared version
+// survives restarts and stays invisible until it is published or aborted. A copy written in
+// order was hashed as its blocks came in and is not read again.
+func (s *Store) Prepare(name string, version int, upload string, size int64, checksum string) error {
+	staged, err := s.stagingPath(name, version, upload)
+	if err != nil {
+		return err
+	}
+	prepared := staged + preparedSuffix
+	if _, err := os.Stat(prepared); err == nil {
+		s.forgetSum(staged)
+		return nil
+	}
+	sum := s.stagedSum(staged, size)
+	f, err := os.OpenFile(staged, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	if info.Size() != size {
+		f.Close()
+		os.Remove(staged)
+		return fmt.Errorf("[%s] version [%d] has [%d] bytes, expected [%d]: %w", name, version, info.Size(), size, ErrMismatch)
+	}
+	if sum == "" {
+		if sum, err = Checksum(f); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if checksum != "" && sum != checksum {
+		f.Close()
+		os.Remove(staged)
+		return fmt.Errorf("[%s] version [%d] has checksum [%s], expected [%s]: %w", name, version, sum, checksum, ErrMismatch)
+	}
+	if err := writeFileSync(prepared + checksumSuffix, []byte(sum)); err != nil {
+		f.Close()
+		return err
+	}
+	// flush the data before the version counts as prepared
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(staged, prepared); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(staged))
+}
+
+// Publish makes the version an upload prepared visible under its final name
+func (s *Store) Publish(name string, version int, upload string) error {
+	staged, err := s.stagingPath(name, version, upload)
+	if err != nil {
+		return err
+	}
+	dir, err := s.fileDir(name)
+	if err != nil {
+		return err
+	}
+	final := filepath.Join(dir, strconv.Itoa(version))
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	// the checksum goes first, a version is never visible without it
+	if err := os.Rename(staged+preparedSuffix+checksumSuffix, final+checksumSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if err := os.Rename(staged+preparedSuffix, final); err != nil {
+		// publishing twice is fine, the coordinator may resend a commit
+		if _, serr := os.Stat(final); serr == nil {
+			return nil
+		}
+		return err
+	}
+	if err := syncDir(dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dir))
+}
+
+// Commit prepares and publishes a staged version in one step
+func (s *Store) Commit(name string, version int, upload string, size int64, checksum string) error {
+	if err := s.Prepare(name, version, upload, size, checksum); err != nil {
+		return err
+	}
+	return s.Publish(name, version, upload)
+}
+
+// Abort throws away the version an upload staged or prepared
+func (s *Store) Abort(name string, version int, upload string) error {
+	staged, err := s.stagingPath(name, version, upload)
+	if err != nil {
+		return err
+	}
+	s.forgetSum(staged)
+	for _, path := range []string{staged, staged + preparedSuffix, staged + preparedSuffix + checksumSuffix} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Discard removes what an upload staged so far, a version it prepared is left alone
+// for the coordinator to commit or abort
+func (s *Store) Discard(name string, version int, upload string) error {
+	staged, err := s.stagingPath(name, version, upload)
+	if err != nil {
+		return err
+	}
+	s.forgetSum(staged)
+	if err := os.Remove(staged); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// ExpireStaging removes staged versions nobody wrote to for maxAge, as left behind by clients
+// that died halfway through a put. Prepared versions wait for the coordinator's decision instead.
+func (s *Store) ExpireStaging(maxAge time.Duration) ([]string, error) {
+	dir := filepath.Join(s.dir, stagingDir)
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	expired := []string{}
+	for _, e := range entries {
+		if strings.Contains(e.Name(), preparedSuffix) {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || time.Since(info.ModTime()) < maxAge {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, e.Name())); err == nil {
+			s.forgetSum(filepath.Join(dir, e.Name()))
+			expired = append(expired, e.Name())
+		}
+	}
+	return expired, nil
+}
+
+// Checksum returns the hex encoded SHA-256 of everything r yields
+func Checksum(r io.Reader) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// VersionChecksum returns the checksum a committed version was stored with. Versions stored
+// before checksums were kept are hashed once and remembered.
+func (s *Store) VersionChecksum(name string, version int) (string, error) {
+	dir, err := s.fileDir(name)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, strconv.Itoa(version))
+	sum, err := os.ReadFile(path + checksumSuffix)
+	if err == nil {
+		return string(sum), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return "", err
+	}
+	f, _, err := s.Open(name, version)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	checksum, err := Checksum(f)
+	if err != nil {
+		return "", err
+	}
+	if err := writeFileSync(path + checksumSuffix, []byte(checksum)); err != nil {
+		return "", err
+	}
+	return checksum, nil
+}
+
+// writes a small file and flushes it
+func writeFileSync(path string, data []byte) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// Versions lists the committed versions of a file in ascending order
+func (s *Store) Versions(name string) ([]int, error) {
+	dir, err := s.fileDir(name)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	entries, err := os.ReadDir(dir)
+	s.mu.Unlock()
+	if errors.Is(err, os.ErrNotExist) {
+		return []int{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	versions := []int{}
+	for _, e := range entries {
+		version, err := strconv.Atoi(e.Name())
+		if err == nil {
+			versions = append(versions, version)
+		}
+	}
+	sort.Ints(versions)
+	return versions, nil
+}
+
+// Latest returns the newest committed version of a file, or ErrNotFound
+func (s *Store) Latest(name string) (int, error) {
+	versions, err := s.Versions(name)
+	if err != nil {
+		return 0, err
+	}
+	if len(versions) == 0 {
+		return 0, fmt.Errorf("[%s]: %w", name, ErrNotFound)
+	}
+	return versions[len(versions)-1], nil
+}
+
+// Open opens a committed version for reading, version 0 opens the latest one
+func (s *Store) Open(name string, version int) (*os.File, int, error) {
+	if version == 0 {
+		latest, err := s.Latest(name)
+		if err != nil {
+			return nil, 0, err
+		}
+		version = latest
+	}
+	dir, err := s.fileDir(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(filepath.Join(dir, strconv.Itoa(version)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, fmt.Errorf("[%s] version [%d]: %w", name, version, ErrNotFound)
+	}
+	return f, version, err
+}
+
+// Delete removes every version of a file
+func (s *Store) Delete(name string) error {
+	dir, err := s.fileDir(name)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	return syncDir(filepath.Dir(dir))
+}
+
+// Files lists the names of every file with at least one committed version
+func (s *Store) Files() ([]string, error) {
+	s.mu.Lock()
+	entries, err := os.ReadDir(filepath.Join(s.dir, filesDir))
+	s.mu.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		name, err := url.PathUnescape(e.Name())
+		if err != nil {
+			continue
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
@@ -0,0 +1,93 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+// a failed copy of a version discards only what it staged, the prepared copy of a put is kept
+func TestDiscardKeepsPreparedVersion(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("prepared by a put")
+	sum, err := Checksum(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock("a#0", 1, "put", 0, data); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepare("a#0", 1, "put", int64(len(data)), sum); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.WriteBlock("a#0", 1, "pull", 0, []byte("half a cop")); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Discard("a#0", 1, "pull"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Discard("a#0", 1, "put"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Publish("a#0", 1, "put"); err != nil {
+		t.Fatalf("prepared version is gone: %v", err)
+	}
+	f, _, err := s.Open("a#0", 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("published [%s], want [%s]", got, data)
+	}
+}
+
+// blocks written in order are hashed as they come in, a copy with a block written twice or started over
+// is checked against the same checksum
+func TestPrepareChecksOutOfOrderBlocks(t *testing.T) {
+	s, err := NewStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte("first block,second block")
+	sum, err := Checksum(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	writes := map[string][]int64{
+		"ordered": {0, 12},
+		"resent": {0, 12, 12},
+		"restarted": {0, 12, 0, 12},
+		"repeated": {0, 0, 12},
+	}
+	for upload, offsets := range writes {
+		for _, offset := range offsets {
+			end := int64(len(data))
+			if offset == 0 {
+				end = 12
+			}
+			if err := s.WriteBlock("a#0", 1, upload, offset, data[offset:end]); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.Prepare("a#0", 1, upload, int64(len(data)), sum); err != nil {
+			t.Fatalf("prepare of the [%s] copy: %v", upload, err)
+		}
+	}
+
+	if err := s.WriteBlock("a#0", 1, "wrong", 0, []byte("first block,second blocK")); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Prepare("a#0", 1, "wrong", int64(len(data)), sum); !errors.Is(err, ErrMismatch) {
+		t.Fatalf("prepare of a copy with other data returned %v, want a mismatch", err)
+	}
+}
@@ -0,0 +1,420 @@
+// Package testcluster runs a whole sdfs cluster inside one process for end-to-end tests.
+// Every node listens on its own ephemeral loopback port with its own rpc server and keeps
+// its data in a temporary directory, so nodes can be killed, paused and restarted at will.
+package testcluster
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/client"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/coordinator"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/faults"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/membership"
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/replica"
+)
+
+const (
+	Host = "127.0.0.1"
+	DefaultWaitTimeout = 20 * time.Second
+)
+
+type Options struct {
+	// number of coordinator candidates, at least one
+	Candidates int
+	Replicas int
+	NumReplicas int
+	WriteQuorum int
+	ReadQuorum int
+	Membership membership.Config
+	SuspectProbes int
+	EvictionGrace time.Duration
+	SnapshotInterval int
+	ChunkSize int64
+	// time between two scrubs of a replica, no scrubs if 0
+	ScrubInterval time.Duration
+	ScrubRate int64
+	// time between two anti-entropy rounds of a replica, none if 0
+	AntiEntropyInterval time.Duration
+	// time between two hint replays of a replica, none if 0
+	HintReplayInterval time.Duration
+	// first delay before the coordinator retries failed work, the coordinator's default if 0
+	RetryBackoff time.Duration
+	// seed of the random faults the network injects
+	Seed int64
+}
+
+// DefaultOptions describe a single coordinator and four replicas tuned to detect failures within seconds
+func DefaultOptions() Options {
+	config := membership.DefaultConfig()
+	config.ProtocolPeriod = 100 * time.Millisecond
+	config.PingTimeout = 50 * time.Millisecond
+	config.SuspicionTimeout = 500 * time.Millisecond
+	return Options{
+		Candidates: 1,
+		Replicas: 4,
+		NumReplicas: 3,
+		WriteQuorum: 2,
+		ReadQuorum: 2,
+		Membership: config,
+		SuspectProbes: 2,
+		EvictionGrace: 300 * time.Millisecond,
+		SnapshotInterval: coordinator.DefaultSnapshotInterval,
+		ChunkSize: common.DefaultChunkSize,
+	}
+}
+
+// Node is one coordinator candidate or replica of the cluster
+type Node struct {
+	Name string
+	Self common.Node
+	// data directory of a replica, metadata directory of a coordinator
+	Dir string
+	Coordinator *coordinator.Coordinator
+	Replica *replica.Replica
+	// how this node finds the leader, its calls go through the cluster's network
+	Coordinators *common.Coordinators
+	cluster *Cluster
+	listener *listener
+	mu sync.Mutex
+}
+
+type Cluster struct {
+	Options Options
+	Dir string
+	Candidates []*Node
+	Replicas []*Node
+	// the test's own view of the coordinators, its calls are not subject to faults
+	Coordinators *common.Coordinators
+	// every call between nodes goes through it, tests add faults to it
+	Network *faults.Network
+}
+
+// New starts the coordinator candidates, waits for a leader and joins every replica to the ring.
+// Call Close once done, it removes every file the cluster stored.
+func New(options Options) (*Cluster, error) {
+	if options.Candidates < 1 {
+		return nil, fmt.Errorf("a cluster needs at least one coordinator candidate")
+	}
+	dir, err := os.MkdirTemp("", "sdfs-cluster")
+	if err != nil {
+		return nil, err
+	}
+	c := &Cluster{
+		Options: options,
+		Dir: dir,
+		Network: faults.NewNetwork(common.DefaultTransport, options.Seed),
+	}
+	// ports are picked before anything starts, every node needs the candidates' addresses
+	candidates := []string{}
+	for i := 0; i < options.Candidates; i++ {
+		n, err := c.newNode(fmt.Sprintf("coordinator-%d", i))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		c.Candidates = append(c.Candidates, n)
+		candidates = append(candidates, n.Self.Addr())
+	}
+	c.Coordinators = common.NewCoordinators(candidates)
+	for _, n := range c.Candidates {
+		n.Coordinators = c.nodeCoordinators(n)
+	}
+	for i := 0; i < options.Replicas; i++ {
+		n, err := c.newNode(fmt.Sprintf("replica-%d", i))
+		if err != nil {
+			c.Close()
+			return nil, err
+		}
+		n.Coordinators = c.nodeCoordinators(n)
+		c.Replicas = append(c.Replicas, n)
+	}
+
+	for _, n := range append(c.Candidates, c.Replicas...) {
+		if err := n.start(); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if _, err := c.Leader(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, n := range c.Replicas {
+		if err := c.Join(n); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+func (c *Cluster) newNode(name string) (*Node, error) {
+	l, err := net.Listen("tcp", Host + ":0")
+	if err != nil {
+		return nil, err
+	}
+	n := &Node{
+		Name: name,
+		Self: common.Node{
+			Address: Host,
+			Port: l.Addr().(*net.TCPAddr).Port,
+		},
+		Dir: filepath.Join(c.Dir, name),
+		cluster: c,
+		listener: newListener(l),
+	}
+	return n, nil
+}
+
+func (c *Cluster) nodeCoordinators(n *Node) *common.Coordinators {
+	coordinators := common.NewCoordinators(c.Coordinators.Candidates)
+	coordinators.Transport = c.Network.Transport(n.Self.Addr())
+	return coordinators
+}
+
+// builds the node's coordinator or replica on top of whatever its directory holds and starts serving
+func (n *Node) start() error {
+	c := n.cluster
+	members := membership.New(n.Self, c.Options.Membership)
+	members.Transport = n.Coordinators.Transport
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.isCandidate() {
+		co := coordinator.NewCoordinator(n.Self, c.Options.NumReplicas, c.Options.WriteQuorum, c.Options.ReadQuorum, map[string]common.Node{}, c.Coordinators.Candidates, members, c.Options.Membership.PingTimeout)
+		co.SuspectProbes = c.Options.SuspectProbes
+		co.EvictionGrace = c.Options.EvictionGrace
+		if c.Options.ChunkSize > 0 {
+			co.ChunkSize = c.Options.ChunkSize
+		}
+		if c.Options.RetryBackoff > 0 {
+			co.RetryBackoff = c.Options.RetryBackoff
+		}
+		co.Transport = n.Coordinators.Transport
+		if err := co.Recover(n.Dir, c.Options.SnapshotInterval); err != nil {
+			return err
+		}
+		n.Coordinator = co
+		go co.Serve(n.listener)
+		return nil
+	}
+	r, err := replica.NewReplica(n.Self, n.Self.Port, n.Dir, n.Coordinators, members)
+	if err != nil {
+		return err
+	}
+	r.Transport = n.Coordinators.Transport
+	r.ScrubInterval = c.Options.ScrubInterval
+	r.ScrubRate = c.Options.ScrubRate
+	r.AntiEntropyInterval = c.Options.AntiEntropyInterval
+	r.HintReplayInterval = c.Options.HintReplayInterval
+	n.Replica = r
+	go r.Serve(n.listener)
+	return nil
+}
+
+func (n *Node) isCandidate() bool {
+	for _, candidate := range n.cluster.Candidates {
+		if candidate == n {
+			return true
+		}
+	}
+	return false
+}
+
+func (n *Node) stop() {
+	if n.Coordinator != nil {
+		n.Coordinator.Stop()
+	}
+	if n.Replica != nil {
+		n.Replica.Stop()
+	}
+}
+
+// Kill crashes the node: it stops answering and stops every background loop. Its files stay on disk.
+func (n *Node) Kill() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.listener.Close()
+	n.stop()
+}
+
+// Pause freezes the node like a long GC pause would: requests hang and its background loops stop
+// until Resume, nothing it holds in memory is lost
+func (n *Node) Pause() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.listener.Pause()
+	n.stop()
+}
+
+func (n *Node) Resume() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.Coordinator != nil {
+		n.Coordinator.Start()
+	}
+	if n.Replica != nil {
+		n.Replica.Start()
+	}
+	n.listener.Resume()
+}
+
+// Restart brings a killed node back on the same address, recovering from what it left on disk
+func (n *Node) Restart() error {
+	n.mu.Lock()
+	l, err := net.Listen("tcp", n.Self.Addr())
+	if err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.listener = newListener(l)
+	n.Coordinator = nil
+	n.Replica = nil
+	n.mu.Unlock()
+	return n.start()
+}
+
+// Leader waits until a candidate leads and returns it
+func (c *Cluster) Leader() (*Node, error) {
+	var leader *Node
+	err := c.WaitFor(func() bool {
+		for _, n := range c.Candidates {
+			n.mu.Lock()
+			co, down := n.Coordinator, n.listener.Down()
+			n.mu.Unlock()
+			if co != nil && !down && co.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	}, DefaultWaitTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("no coordinator was elected: %w", err)
+	}
+	return leader, nil
+}
+
+// Join adds a replica to the ring through the leader
+func (c *Cluster) Join(n *Node) error {
+	return c.Coordinators.Call("Coordinator.Join", &n.Self, new(common.JoinAck), coordinator.ReplicationTimeout)
+}
+
+// Client returns a client that talks to the cluster like the sdfs command line of the node does,
+// through the node's link to the network
+func (c *Cluster) Client(n *Node) *client.Client {
+	return &client.Client{
+		Self: n.Self,
+		Coordinators: n.Coordinators,
+	}
+}
+
+// Ring returns the nodes the leader currently has on its ring
+func (c *Cluster) Ring() (map[string]common.Node, error) {
+	resp := new(common.MemListResponse)
+	if err := c.Coordinators.Call("Coordinator.MemList", &common.MemListRequest{}, resp, coordinator.RequestTimeout); err != nil {
+		return nil, err
+	}
+	return *resp, nil
+}
+
+// Replicas of a file according to the leader
+func (c *Cluster) FileReplicas(name string) ([]string, error) {
+	req := common.LsRequest{
+		Filename: name,
+	}
+	resp := new(common.LsResponse)
+	if err := c.Coordinators.Call("Coordinator.Ls", &req, resp, coordinator.RequestTimeout); err != nil {
+		return nil, err
+	}
+	return resp.Addresses, nil
+}
+
+// WaitFor polls cond until it holds or the timeout passes
+func (c *Cluster) WaitFor(cond func() bool, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("condition not met within %s", timeout)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	return nil
+}
+
+// Close kills every node and removes the cluster's files
+func (c *Cluster) Close() {
+	for _, n := range append(c.Candidates, c.Replicas...) {
+		n.Kill()
+	}
+	os.RemoveAll(c.Dir)
+}
+
+// listener lets a node stop answering without giving up its port
+type listener struct {
+	net.Listener
+	paused bool
+	closed bool
+	mu sync.Mutex
+	resumed *sync.Cond
+}
+
+func newListener(l net.Listener) *listener {
+	pl := &listener{
+		Listener: l,
+	}
+	pl.resumed = sync.NewCond(&pl.mu)
+	return pl
+}
+
+// Accept holds connections while the listener is paused, their callers hang until they time out
+func (l *listener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for l.paused {
+		l.resumed.Wait()
+	}
+	if l.closed {
+		conn.Close()
+		return nil, net.ErrClosed
+	}
+	return conn, nil
+}
+
+func (l *listener) Pause() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paused = true
+}
+
+func (l *listener) Resume() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.paused = false
+	l.resumed.Broadcast()
+}
+
+func (l *listener) Close() error {
+	l.mu.Lock()
+	l.closed = true
+	l.paused = false
+	l.resumed.Broadcast()
+	l.mu.Unlock()
+	return l.Listener.Close()
+}
+
+// Down reports whether the node is paused or killed
+func (l *listener) Down() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.paused || l.closed
+}
@@ -0,0 +1,162 @@
+package testcluster
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/common"
+)
+
+func TestPutGetDelete(t *testing.T) {
+	c := Start(t, DefaultOptions())
+	cl := c.Client(c.Replicas[0])
+
+	if err := Put(t, cl, "a", "first"); err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, c.Client(c.Replicas[1]), "a", -1, "first")
+	if err := Put(t, cl, "a", "second"); err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, c.Client(c.Replicas[2]), "a", -1, "second")
+	replicas, err := c.FileReplicas("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(replicas) != c.Options.NumReplicas {
+		t.Fatalf("[a] is on [%d] replicas, want [%d]", len(replicas), c.Options.NumReplicas)
+	}
+
+	if err := cl.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Get(t, cl, "a", -1); common.CodeOf(err) != common.NotFound {
+		t.Fatalf("get of deleted [a] returned %v, want not-found", err)
+	}
+	if err := cl.Delete("a"); common.CodeOf(err) != common.NotFound {
+		t.Fatalf("second delete of [a] returned %v, want not-found", err)
+	}
+}
+
+// a killed replica is evicted from the ring and its files are copied to the replicas left
+func TestKilledReplicaIsEvicted(t *testing.T) {
+	c := Start(t, DefaultOptions())
+	cl := c.Client(c.Replicas[0])
+	if err := Put(t, cl, "a", "content"); err != nil {
+		t.Fatal(err)
+	}
+	victim := c.Holder(t, "a", c.Replicas[0])
+	// the gossip has to know the replica before it can declare it dead
+	time.Sleep(time.Second)
+	victim.Kill()
+
+	err := c.WaitFor(func() bool {
+		ring, err := c.Ring()
+		if err != nil {
+			return false
+		}
+		_, ok := ring[victim.Self.Addr()]
+		return !ok
+	}, DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("[%s] was not evicted: %v", victim.Self.Addr(), err)
+	}
+	err = c.WaitFor(func() bool {
+		replicas, err := c.FileReplicas("a")
+		if err != nil || len(replicas) != c.Options.NumReplicas {
+			return false
+		}
+		for _, addr := range replicas {
+			if addr == victim.Self.Addr() {
+				return false
+			}
+		}
+		return true
+	}, DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("[a] was not re-replicated: %v", err)
+	}
+	Expect(t, cl, "a", -1, "content")
+}
+
+// a restarted coordinator recovers files and ring from its metadata directory
+func TestCoordinatorRestart(t *testing.T) {
+	c := Start(t, DefaultOptions())
+	cl := c.Client(c.Replicas[0])
+	if err := Put(t, cl, "a", "content"); err != nil {
+		t.Fatal(err)
+	}
+
+	coordinator := c.Candidates[0]
+	coordinator.Kill()
+	if err := Put(t, cl, "b", "content"); common.CodeOf(err) != common.Unavailable {
+		t.Fatalf("put without a coordinator returned %v, want unavailable", err)
+	}
+	if err := coordinator.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Leader(); err != nil {
+		t.Fatal(err)
+	}
+
+	ring, err := c.Ring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ring) != len(c.Replicas) {
+		t.Fatalf("ring has [%d] nodes after the restart, want [%d]", len(ring), len(c.Replicas))
+	}
+	Expect(t, cl, "a", -1, "content")
+	if err := Put(t, cl, "a", "more"); err != nil {
+		t.Fatal(err)
+	}
+	Expect(t, cl, "a", -1, "more")
+}
+
+// killing the leader hands its files to a newly elected one, the old leader catches up on restart
+func TestLeaderFailover(t *testing.T) {
+	options := DefaultOptions()
+	options.Candidates = 3
+	c := Start(t, options)
+	cl := c.Client(c.Replicas[0])
+	if err := Put(t, cl, "a", "content"); err != nil {
+		t.Fatal(err)
+	}
+
+	old, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	old.Kill()
+	leader, err := c.Leader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leader == old {
+		t.Fatalf("[%s] still leads after it was killed", old.Name)
+	}
+	Expect(t, cl, "a", -1, "content")
+	for i := 0; i < 3; i++ {
+		if err := Put(t, cl, fmt.Sprintf("b%d", i), "content"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := old.Restart(); err != nil {
+		t.Fatal(err)
+	}
+	// without the third candidate, commits need the restarted one to have caught up
+	for _, n := range c.Candidates {
+		if n != old && n != leader {
+			n.Kill()
+		}
+	}
+	err = c.WaitFor(func() bool {
+		return Put(t, cl, "c", "content") == nil
+	}, DefaultWaitTimeout)
+	if err != nil {
+		t.Fatalf("the restarted candidate did not catch up: %v", err)
+	}
+	Expect(t, cl, "b2", -1, "content")
+}
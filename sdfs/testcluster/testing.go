@@ -0,0 +1,70 @@
+package testcluster
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"gitlab.engr.illinois.edu/akroy2/mp3/sdfs/client"
+)
+
+// Start runs a cluster for a test and closes it when the test ends
+func Start(t testing.TB, options Options) *Cluster {
+	t.Helper()
+	c, err := New(options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// Put stores content as target through cl. It may be called from any goroutine of the test.
+func Put(t testing.TB, cl *client.Client, target string, content string) error {
+	local := filepath.Join(t.TempDir(), "put")
+	if err := os.WriteFile(local, []byte(content), 0644); err != nil {
+		return err
+	}
+	return cl.Put(local, target, -1)
+}
+
+// Get reads version of target through cl, the latest version if version is -1. It may be called from
+// any goroutine of the test.
+func Get(t testing.TB, cl *client.Client, target string, version int) (string, error) {
+	local := filepath.Join(t.TempDir(), "get")
+	if err := cl.Get(target, local, version); err != nil {
+		return "", err
+	}
+	data, err := os.ReadFile(local)
+	return string(data), err
+}
+
+// Expect fails the test unless version of target reads back as want, the latest version if version is -1
+func Expect(t testing.TB, cl *client.Client, target string, version int, want string) {
+	t.Helper()
+	got, err := Get(t, cl, target, version)
+	if err != nil {
+		t.Fatalf("get of [%s] version [%d]: %v", target, version, err)
+	}
+	if got != want {
+		t.Fatalf("[%s] version [%d] holds [%s], want [%s]", target, version, got, want)
+	}
+}
+
+// Holder returns a replica other than except that stores a file according to the leader
+func (c *Cluster) Holder(t testing.TB, name string, except *Node) *Node {
+	t.Helper()
+	replicas, err := c.FileReplicas(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, n := range c.Replicas {
+		for _, addr := range replicas {
+			if n != except && n.Self.Addr() == addr {
+				return n
+			}
+		}
+	}
+	t.Fatalf("[%s] is on no replica but [%s]", name, except.Name)
+	return nil
+}